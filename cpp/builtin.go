@@ -0,0 +1,110 @@
+package cpp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// the revision of the C standard preprocessed for
+type Std uint
+
+const (
+	DefaultStd Std = iota // same as C17
+	C89
+	C99
+	C11
+	C17
+	C23
+)
+
+var stdVersion = map[Std]string{
+	C99: "199901L",
+	C11: "201112L",
+	C17: "201710L",
+	C23: "202311L",
+}
+
+// defines the macros every translation unit starts with
+func (p *Parser) predefine() {
+	p.now = p.opts.Now()
+
+	std := p.opts.Std
+	if std == DefaultStd {
+		std = C17
+	}
+
+	p.builtin("__STDC__", "1")
+	p.builtin("__STDC_HOSTED__", "1")
+	if v, ok := stdVersion[std]; ok {
+		p.builtin("__STDC_VERSION__", v)
+	}
+	p.builtin("__DATE__", quote(p.now.Format("Jan _2 2006")))
+	p.builtin("__TIME__", quote(p.now.Format("15:04:05")))
+
+	p.macros["__FILE__"] = &macro{name: "__FILE__", dynamic: func(p *Parser) Token {
+		return Token{Type: STRING, Literal: quote(p.presumed)}
+	}}
+	p.macros["__LINE__"] = &macro{name: "__LINE__", dynamic: func(p *Parser) Token {
+		return Token{Type: PPNUM, Literal: strconv.Itoa(p.where)}
+	}}
+	p.macros["__COUNTER__"] = &macro{name: "__COUNTER__", dynamic: func(p *Parser) Token {
+		p.counter++
+		return Token{Type: PPNUM, Literal: strconv.Itoa(p.counter - 1)}
+	}}
+	// operators of #if and #elif, defined for #ifdef to find them
+	for _, name := range []string{"__has_include", "__has_include_next"} {
+		p.macros[name] = &macro{name: name, dynamic: func(p *Parser) Token {
+			p.error("\"%s\" used outside of preprocessing directive", name)
+			return Token{Type: IDENT, Literal: name, Hide: Hideset{name: true}}
+		}}
+	}
+
+	for _, m := range p.macros {
+		m.def = Location{File: "<built-in>"}
+	}
+}
+
+// each definition is read as the corresponding directive would be
+func (p *Parser) commandLine() {
+	p.name, p.presumed = "<command-line>", "<command-line>"
+
+	for _, def := range p.opts.Macros {
+		name, value, ok := strings.Cut(def.Text, "=")
+		if !ok {
+			value = "1"
+		}
+
+		if def.Undef {
+			p.read(def.Text)
+			p.undef()
+			p.extraTokens("undef")
+		} else {
+			p.read(name + " " + value)
+			p.define()
+		}
+	}
+}
+
+// makes src the input of the parser
+func (p *Parser) read(src string) {
+	p.l = p.lexer(src)
+	p.curr, p.next = Token{}, Token{}
+	p.adv()
+	p.adv()
+}
+
+// a lexer for src, reading pp-numbers as the language standard says
+func (p *Parser) lexer(src string) *Lexer {
+	return newLexer(src, p.opts.Std == C23)
+}
+
+func (p *Parser) builtin(name string, value string) {
+	p.macros[name] = &macro{name: name, body: tokenize(value)}
+}
+
+// spells s as a string literal
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
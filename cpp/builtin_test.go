@@ -0,0 +1,116 @@
+package cpp
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestPredefinedMacros(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 9, 7, 3, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	tt := []struct {
+		std    Std
+		input  string
+		output string
+	}{
+		{DefaultStd, "__STDC__ __STDC_HOSTED__", "1 1"},
+		{DefaultStd, "__STDC_VERSION__", "201710L"},
+		{C89, "__STDC_VERSION__", "__STDC_VERSION__"},
+		{C99, "__STDC_VERSION__", "199901L"},
+		{C11, "__STDC_VERSION__", "201112L"},
+		{C17, "__STDC_VERSION__", "201710L"},
+		{C23, "__STDC_VERSION__", "202311L"},
+		{DefaultStd, "__DATE__ __TIME__", `"Mar  5 2024" "09:07:03"`},
+		{DefaultStd, "#if __STDC_VERSION__ >= 201112L\nyes\n#endif\n", "\nyes\n\n"},
+		{DefaultStd, "#ifdef __FILE__\nyes\n#endif\n", "\nyes\n\n"},
+	}
+
+	for _, test := range tt {
+		opts := Options{Std: test.std, Now: clock}
+		check(t, NewParserOptions(New(test.input), opts), test.output)
+	}
+}
+
+func TestDynamicMacros(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/a.h": {Data: []byte("__FILE__ __LINE__\n")},
+	}
+	opts := Options{Filename: "main.c", FS: fsys}
+
+	tt := []Pair{
+		{"__FILE__", `"main.c"`},
+		{"a\n\n__LINE__\n", "a\n\n3\n"},
+		{"#define L __LINE__\n\nL\n", "\n\n3\n"},
+		{"#include \"dir/a.h\"\n__FILE__ __LINE__\n", "\n\"dir/a.h\" 1\n\"main.c\" 2\n"},
+		{"__COUNTER__ __COUNTER__\n__COUNTER__", "0 1\n2"},
+		// an argument is expanded once, not at each use
+		{"#define twice(x) x x\ntwice(__COUNTER__)", "\n0 0"},
+		{"#define s(x) #x\n#define xs(x) s(x)\nxs(__LINE__)", "\n\n\"3\""},
+	}
+
+	for _, test := range tt {
+		check(t, NewParserOptions(New(test.input), opts), test.output)
+	}
+
+	check(t, NewParserOptions(New("__FILE__"), Options{Filename: `a\"b.c`}),
+		`"a\\\"b.c"`)
+}
+
+func TestPhysicalLines(t *testing.T) {
+	// lines joined by splices and comments still count
+	tt := []string{
+		"#define A \\\n 1\n#if __LINE__ != 3\n#error\n#endif\n",
+		"a /* x\n y */ b\n#if __LINE__ != 3\n#error\n#endif\n",
+		"#line \\\n10\n#if __LINE__ != 10\n#error\n#endif\n",
+		"#define f(x) x\nf(\n1\n) /*\n*/\n#if __LINE__ != 6\n#error\n#endif\n",
+	}
+	for _, src := range tt {
+		if _, err := NewParser(New(src)).Expand(); len(err) != 0 {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+
+	_, err := NewParser(New("#define A \\\n 1\n#if\n#endif\n")).Expand()
+	if len(err) != 1 || err[0].Error() != "line 3: #if with no expression" {
+		t.Errorf("expected the error on line 3, got %v", err)
+	}
+}
+
+func TestCommandLineMacros(t *testing.T) {
+	tt := []struct {
+		macros []MacroDef
+		input  string
+		output string
+	}{
+		{[]MacroDef{{Text: "A"}}, "A", "1"},
+		{[]MacroDef{{Text: "A=2"}}, "A", "2"},
+		{[]MacroDef{{Text: "A="}}, "[A]", "[]"},
+		{[]MacroDef{{Text: "A=x=y"}}, "A", "x=y"},
+		{[]MacroDef{{Text: "f(a,b)=a+b"}}, "f(1, 2)", "1+2"},
+		{[]MacroDef{{Text: "s(x)=#x"}}, "s(a b)", `"a b"`},
+		{[]MacroDef{{Text: "A"}, {Undef: true, Text: "A"}}, "A", "A"},
+		{[]MacroDef{{Undef: true, Text: "A"}, {Text: "A"}}, "A", "1"},
+		{[]MacroDef{{Undef: true, Text: "__STDC__"}}, "__STDC__", "__STDC__"},
+		{[]MacroDef{{Text: "A=1"}}, "#if A\nyes\n#endif\n", "\nyes\n\n"},
+	}
+
+	for _, test := range tt {
+		opts := Options{Macros: test.macros}
+		check(t, NewParserOptions(New(test.input), opts), test.output)
+	}
+
+	errs := [][]MacroDef{
+		{{Text: "1=2"}},
+		{{Text: "f(=1"}},
+		{{Undef: true, Text: "A B"}},
+		{{Text: "A=1"}, {Text: "A=2"}},
+	}
+	for _, macros := range errs {
+		p := NewParserOptions(New(""), Options{Macros: macros})
+		if _, err := p.Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %v", macros)
+		}
+	}
+}
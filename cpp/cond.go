@@ -0,0 +1,176 @@
+package cpp
+
+// one if-section on the conditional stack
+type cond struct {
+	directive string
+	line      int
+	// the current group is included
+	active bool
+	// a group of the section was already included, or the section is
+	// nested in a skipped group, so no further group can be
+	done    bool
+	sawElse bool
+}
+
+func (p *Parser) skipping() bool {
+	return len(p.conds) > 0 && !p.conds[len(p.conds)-1].active
+}
+
+// if-group, elif-group, else-group and the closing #endif; inside of skipped
+// groups nothing but the nesting of the sections is looked at
+func (p *Parser) conditional() {
+	directive := p.curr.Literal
+	ttype := p.curr.Type
+	p.adv()
+	p.skipWS()
+
+	switch ttype {
+	case IF, IFDEF, IFNDEF:
+		c := cond{directive: directive, line: p.where}
+
+		if ttype == IFNDEF && p.guard.state == guardStart && isIdent(p.curr) {
+			p.guard = guard{guardOpen, p.curr.Literal, len(p.conds)}
+		} else {
+			p.unguarded()
+		}
+
+		if p.skipping() {
+			c.done = true
+		} else {
+			c.active = p.condition(ttype)
+			c.done = c.active
+		}
+
+		p.conds = append(p.conds, c)
+	case ELIF:
+		c := p.top(directive)
+		if c == nil {
+			return
+		} else if c.sawElse {
+			p.error("#elif after #else")
+			return
+		}
+		p.unguardedBy(len(p.conds) - 1)
+
+		if c.done {
+			c.active = false
+		} else {
+			c.active = p.condition(ttype)
+			c.done = c.active
+		}
+	case ELSE:
+		c := p.top(directive)
+		if c == nil {
+			return
+		} else if c.sawElse {
+			p.error("#else after #else")
+			return
+		}
+		p.unguardedBy(len(p.conds) - 1)
+
+		c.sawElse = true
+		c.active = !c.done
+		c.done = true
+		p.extraTokens(directive)
+	case ENDIF:
+		if p.top(directive) == nil {
+			return
+		}
+
+		p.conds = p.conds[:len(p.conds)-1]
+		if p.guard.state == guardOpen && p.guard.cond == len(p.conds) {
+			p.guard.state = guardClosed
+		}
+		p.extraTokens(directive)
+	}
+}
+
+// the innermost if-section, or nil when there is none to continue in the
+// current file
+func (p *Parser) top(directive string) *cond {
+	if len(p.conds) == p.condBase() {
+		p.error("#%s without #if", directive)
+		return nil
+	}
+	return &p.conds[len(p.conds)-1]
+}
+
+// evaluates the controlling expression of #if, #elif, #ifdef and #ifndef
+func (p *Parser) condition(ttype uint) bool {
+	if ttype == IFDEF || ttype == IFNDEF {
+		if !isIdent(p.curr) {
+			p.error("macro name must be an identifier, got %s", toks(p.curr.Type))
+			return false
+		}
+		_, defined := p.macros[p.curr.Literal]
+		p.adv()
+		p.extraTokens(Tmap[ttype])
+
+		return defined == (ttype == IFDEF)
+	}
+
+	expr := []Token{}
+	for !p.is(EOF) && !p.is(NEWLINE) {
+		expr = append(expr, p.curr)
+		p.adv()
+	}
+
+	// the operands of defined are left alone by the expansion, which may
+	// itself produce defined
+	p.inIf = true
+	expr, ok := p.defined(p.expand(expr))
+	p.inIf = false
+	if !ok {
+		return false
+	}
+
+	v, ok := p.evaluate(expr)
+	return ok && v.n != 0
+}
+
+// replaces every "defined X" and "defined ( X )" by 1 or 0
+func (p *Parser) defined(toks []Token) ([]Token, bool) {
+	out := []Token{}
+
+	for i := 0; i < len(toks); i++ {
+		if !isIdent(toks[i]) || toks[i].Literal != "defined" {
+			out = append(out, toks[i])
+			continue
+		}
+
+		j := nextSignificant(toks, i+1)
+		paren := j < len(toks) && toks[j].Type == PUNCT && toks[j].Literal == "("
+		if paren {
+			j = nextSignificant(toks, j+1)
+		}
+		if j >= len(toks) || !isIdent(toks[j]) {
+			p.error("operator \"defined\" requires an identifier")
+			return nil, false
+		}
+		_, ok := p.macros[toks[j].Literal]
+		if paren {
+			j = nextSignificant(toks, j+1)
+			if j >= len(toks) || toks[j].Type != RPAREN {
+				p.error("missing ')' after \"defined\"")
+				return nil, false
+			}
+		}
+
+		if ok {
+			out = append(out, Token{Type: PPNUM, Literal: "1"})
+		} else {
+			out = append(out, Token{Type: PPNUM, Literal: "0"})
+		}
+		i = j
+	}
+
+	return out, true
+}
+
+// nothing may follow the operands of a directive
+func (p *Parser) extraTokens(directive string) {
+	p.skipWS()
+	if !p.is(NEWLINE) && !p.is(EOF) {
+		p.error("extra tokens at end of #%s directive", directive)
+	}
+}
@@ -0,0 +1,80 @@
+package cpp
+
+import "testing"
+
+func TestIfdef(t *testing.T) {
+	tt := []Pair{
+		{"#define A\n#ifdef A\na\n#endif\n", "\n\na\n\n"},
+		{"#ifdef A\na\n#endif\n", "\n\n\n"},
+		{"#ifndef A\na\n#endif\n", "\na\n\n"},
+		{"#ifdef A\na\n#else\nb\n#endif\n", "\n\n\nb\n\n"},
+		{"#define A\n#ifndef A\na\n#else\nb\n#endif\n", "\n\n\n\nb\n\n"},
+		{"  #  ifdef A\na\n  #  endif\nb", "\n\n\nb"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestIf(t *testing.T) {
+	tt := []Pair{
+		{"#if 1\na\n#endif\n", "\na\n\n"},
+		{"#if 0\na\n#endif\n", "\n\n\n"},
+		{"#if 0\na\n#elif 1\nb\n#else\nc\n#endif\n", "\n\n\nb\n\n\n\n"},
+		{"#if 1\na\n#elif 1\nb\n#else\nc\n#endif\n", "\na\n\n\n\n\n\n"},
+		{"#if 0\na\n#elif 0\nb\n#else\nc\n#endif\n", "\n\n\n\n\nc\n\n"},
+		{"#define A 1\n#if A\na\n#endif\n", "\n\na\n\n"},
+		{"#if 0x10\na\n#endif\n", "\na\n\n"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestNestedConditionals(t *testing.T) {
+	tt := []Pair{
+		{"#if 1\n#if 0\na\n#else\nb\n#endif\n#endif\n", "\n\n\n\nb\n\n\n"},
+		{"#if 0\n#if 1\na\n#else\nb\n#endif\nc\n#else\nd\n#endif\n",
+			"\n\n\n\n\n\n\n\nd\n\n"},
+		{"#if 0\n#if 1\n#elif 1\n#else\n#endif\n#endif\nx", "\n\n\n\n\n\nx"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestSkippedGroups(t *testing.T) {
+	tt := []Pair{
+		// macros are neither defined nor expanded in skipped groups
+		{"#define A 1\n#if 0\n#define A 2\nA\n#endif\nA", "\n\n\n\n\n1"},
+		{"#if 0\n#error no\n#include <none>\n#endif\n", "\n\n\n\n"},
+		// nor are their expressions evaluated
+		{"#if 1\n#elif 1 +\n#endif\n", "\n\n\n"},
+		{"#if 0\n#if @\n#endif\n'\n#endif\n", "\n\n\n\n\n"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestConditionalErrors(t *testing.T) {
+	tt := []string{
+		"#endif\n",
+		"#else\n",
+		"#elif 1\n",
+		"#if 1\n",
+		"#ifdef A\n#else\n#else\n#endif\n",
+		"#ifdef A\n#else\n#elif 1\n#endif\n",
+		"#ifdef 1\n#endif\n",
+		"#ifdef A B\n#endif\n",
+		"#if\n#endif\n",
+		"#if 1\n#endif A\n",
+	}
+
+	for _, src := range tt {
+		if _, err := NewParser(New(src)).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+
+	_, err := NewParser(New("a\n\n#if 1\nb\n")).Expand()
+	if len(err) != 1 || err[0].Error() != "line 3: unterminated #if" {
+		t.Errorf("expected unterminated #if at line 3, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package cpp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// a file the translation unit depends on
+type dep struct {
+	name   string
+	system bool
+}
+
+// how WriteDeps writes the dependency rule
+type DepOptions struct {
+	// the target of the rule, the object file of the main file when empty
+	Target string
+	// headers found in the system directories are left out, like -MM
+	NoSystem bool
+	// a rule without prerequisites is added for every header, so that make
+	// does not fail once a header is removed, like -MP
+	Phony bool
+}
+
+// records that name was found by an #include
+func (p *Parser) depend(name string, system bool) {
+	for _, d := range p.deps {
+		if d.name == name {
+			return
+		}
+	}
+	p.deps = append(p.deps, dep{name, system})
+}
+
+// the main file and every file #include found so far, including those not
+// read again because of their include guard; with noSystem the headers
+// found in the system directories are left out
+func (p *Parser) Dependencies(noSystem bool) []string {
+	deps := []string{}
+	if p.opts.Filename != "" {
+		deps = append(deps, p.opts.Filename)
+	}
+
+	for _, d := range p.deps {
+		if !noSystem || !d.system {
+			deps = append(deps, d.name)
+		}
+	}
+
+	return deps
+}
+
+// writes a Makefile rule making the target depend on every file of the
+// translation unit, as gcc -M would; the input has to be expanded first
+func (p *Parser) WriteDeps(w io.Writer, opts DepOptions) error {
+	target := opts.Target
+	if target == "" {
+		if p.opts.Filename == "" {
+			return errors.New("no target for the dependency rule")
+		}
+		base := path.Base(p.opts.Filename)
+		target = strings.TrimSuffix(base, path.Ext(base)) + ".o"
+	}
+
+	deps := p.Dependencies(opts.NoSystem)
+
+	// long rules are continued over several lines
+	var b bytes.Buffer
+	line := len(target) + 1
+	b.WriteString(makeEscape(target) + ":")
+	for _, d := range deps {
+		d = makeEscape(d)
+		if line+len(d)+1 > 76 {
+			b.WriteString(" \\\n")
+			line = 0
+		}
+		b.WriteString(" " + d)
+		line += len(d) + 1
+	}
+	b.WriteString("\n")
+
+	if opts.Phony {
+		for _, d := range deps {
+			if d != p.opts.Filename {
+				fmt.Fprintf(&b, "\n%s:\n", makeEscape(d))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// quotes the characters make treats specially in file names
+func makeEscape(s string) string {
+	s = strings.ReplaceAll(s, "$", "$$")
+	s = strings.ReplaceAll(s, "#", `\#`)
+	return strings.ReplaceAll(s, " ", `\ `)
+}
@@ -0,0 +1,67 @@
+package cpp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDependencies(t *testing.T) {
+	long := strings.Repeat("x", 60) + ".h"
+	fsys := fstest.MapFS{
+		"src/main.c":      {Data: []byte("#include \"a.h\"\n#include <stdio.h>\n#include \"a.h\"\n#include \"my file.h\"\n")},
+		"src/a.h":         {Data: []byte("#ifndef A\n#define A\n#include \"b.h\"\n#endif\n")},
+		"src/b.h":         {Data: []byte("#include <stddef.h>\n")},
+		"src/my file.h":   {Data: []byte("")},
+		"sys/stdio.h":     {Data: []byte("#include <stddef.h>\n")},
+		"sys/stddef.h":    {Data: []byte("")},
+		"include/$x#y.h":  {Data: []byte("")},
+		"include/long.h":  {Data: []byte("#include \"$x#y.h\"\n#include \"" + long + "\"\n")},
+		"include/" + long: {Data: []byte("")},
+	}
+	opts := Options{
+		Filename:   "src/main.c",
+		FS:         fsys,
+		QuoteDirs:  []string{"include"},
+		SystemDirs: []string{"sys"},
+	}
+	src, _ := fsys.ReadFile("src/main.c")
+
+	tt := []struct {
+		deps DepOptions
+		rule string
+	}{
+		{DepOptions{}, "main.o: src/main.c src/a.h src/b.h sys/stddef.h sys/stdio.h src/my\\ file.h\n"},
+		{DepOptions{NoSystem: true}, "main.o: src/main.c src/a.h src/b.h src/my\\ file.h\n"},
+		{DepOptions{Target: "obj/main.o", NoSystem: true, Phony: true},
+			"obj/main.o: src/main.c src/a.h src/b.h src/my\\ file.h\n\nsrc/a.h:\n\nsrc/b.h:\n\nsrc/my\\ file.h:\n"},
+	}
+
+	for _, test := range tt {
+		p := NewParserOptions(New(string(src)), opts)
+		if _, err := p.Expand(); len(err) != 0 {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := p.WriteDeps(&out, test.deps); err != nil {
+			t.Error(err)
+		} else if out.String() != test.rule {
+			t.Errorf("expected\n%s\ngot\n%s", test.rule, out.String())
+		}
+	}
+
+	p := NewParserOptions(New("#include \"long.h\"\n"), Options{FS: fsys, QuoteDirs: []string{"include"}})
+	p.Expand()
+	var out bytes.Buffer
+	if err := p.WriteDeps(&out, DepOptions{Target: "a$b.o"}); err != nil {
+		t.Error(err)
+	} else if want := "a$$b.o: include/long.h include/$$x\\#y.h \\\n include/" + long + "\n"; out.String() != want {
+		t.Errorf("expected %q, got %q", want, out.String())
+	}
+
+	if err := p.WriteDeps(&out, DepOptions{}); err == nil {
+		t.Errorf("missing target not reported")
+	}
+}
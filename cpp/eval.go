@@ -0,0 +1,466 @@
+package cpp
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	lowest  = iota
+	comma   // ,						(left-to-right)
+	ternary // a ? 1 : 0				(right-to-left)
+	or      // ||						(left-to-right)
+	and     // &&						(left-to-right)
+	bor     // |						(left-to-right)
+	bxor    // ^						(left-to-right)
+	band    // &						(left-to-right)
+	eq      // == !=					(left-to-right)
+	order   // < <= > >=				(left-to-right)
+	shift   // << >>					(left-to-right)
+	sum     // + -						(left-to-right)
+	product // * / %					(left-to-right)
+)
+
+var prec = map[string]uint{
+	"*":  product,
+	"/":  product,
+	"%":  product,
+	"+":  sum,
+	"-":  sum,
+	"<<": shift,
+	">>": shift,
+	"<":  order,
+	">":  order,
+	"<=": order,
+	">=": order,
+	"==": eq,
+	"!=": eq,
+	"&":  band,
+	"^":  bxor,
+	"|":  bor,
+	"&&": and,
+	"||": or,
+	"?":  ternary,
+	",":  comma,
+}
+
+// every integer in a constant expression behaves as intmax_t or uintmax_t
+type value struct {
+	n        int64
+	unsigned bool
+}
+
+type evaluator struct {
+	p      *Parser
+	toks   []Token
+	pos    int
+	failed bool
+}
+
+// evaluates the controlling expression of #if and #elif, toks have been
+// macro expanded already and any identifier left stands for 0
+func (p *Parser) evaluate(toks []Token) (value, bool) {
+	e := &evaluator{p: p}
+	for _, tok := range toks {
+		if tok.Type != WS && tok.Type != NEWLINE {
+			e.toks = append(e.toks, tok)
+		}
+	}
+
+	if len(e.toks) == 0 {
+		p.error("#if with no expression")
+		return value{}, false
+	}
+
+	v := e.expr(lowest, true)
+	if !e.failed && e.pos < len(e.toks) {
+		e.error("missing binary operator before token \"%s\"", e.curr().Literal)
+	}
+
+	return v, !e.failed
+}
+
+func (e *evaluator) expr(currPrec uint, eval bool) value {
+	left := e.unary(eval)
+
+	for !e.failed && currPrec < e.prec() {
+		op := e.curr().Literal
+		opPrec := e.prec()
+		e.pos++
+
+		switch op {
+		case "&&", "||":
+			// the right operand is only evaluated when it decides the
+			// result
+			short := (op == "&&") == (left.n == 0)
+			right := e.expr(opPrec, eval && !short)
+			if op == "&&" {
+				left = boolean(left.n != 0 && right.n != 0)
+			} else {
+				left = boolean(left.n != 0 || right.n != 0)
+			}
+		case "?":
+			then := e.expr(lowest, eval && left.n != 0)
+			if !e.failed && (e.pos >= len(e.toks) || e.curr().Literal != ":") {
+				e.error("'?' without following ':'")
+				return value{}
+			}
+			e.pos++
+			// right-to-left, so the else branch is parsed at one level
+			// below its own
+			els := e.expr(opPrec-1, eval && left.n == 0)
+
+			unsigned := then.unsigned || els.unsigned
+			if left.n != 0 {
+				left = value{then.n, unsigned}
+			} else {
+				left = value{els.n, unsigned}
+			}
+		case ",":
+			left = e.expr(opPrec, eval)
+		default:
+			right := e.expr(opPrec, eval)
+			left = e.binary(op, left, right, eval)
+		}
+	}
+
+	return left
+}
+
+func (e *evaluator) unary(eval bool) value {
+	if e.failed {
+		return value{}
+	} else if e.pos >= len(e.toks) {
+		e.error("#if expression ends unexpectedly")
+		return value{}
+	}
+	tok := e.curr()
+	e.pos++
+
+	switch tok.Type {
+	case PPNUM:
+		return e.integer(tok.Literal)
+	case CHAR_CONST:
+		return e.char(tok.Literal)
+	case PUNCT:
+		switch tok.Literal {
+		case "(":
+			v := e.expr(lowest, eval)
+			if !e.failed && (e.pos >= len(e.toks) || e.curr().Type != RPAREN) {
+				e.error("missing ')' in expression")
+				return value{}
+			}
+			e.pos++
+			return v
+		case "+":
+			return e.unary(eval)
+		case "-":
+			v := e.unary(eval)
+			return value{-v.n, v.unsigned}
+		case "~":
+			v := e.unary(eval)
+			return value{^v.n, v.unsigned}
+		case "!":
+			return boolean(e.unary(eval).n == 0)
+		}
+	default:
+		if isIdent(tok) {
+			return value{}
+		}
+	}
+
+	e.error("token \"%s\" is not valid in preprocessor expressions", tok.Literal)
+	return value{}
+}
+
+// applies op after the usual arithmetic conversions
+func (e *evaluator) binary(op string, l, r value, eval bool) value {
+	unsigned := l.unsigned || r.unsigned
+	a, b := uint64(l.n), uint64(r.n)
+
+	switch op {
+	case "*":
+		return value{l.n * r.n, unsigned}
+	case "/", "%":
+		if r.n == 0 {
+			if eval {
+				e.error("division by zero in #if")
+			}
+			return value{0, unsigned}
+		}
+		if unsigned && op == "/" {
+			return value{int64(a / b), true}
+		} else if unsigned {
+			return value{int64(a % b), true}
+		} else if l.n == math.MinInt64 && r.n == -1 {
+			if eval {
+				e.error("integer overflow in preprocessor expression")
+			}
+			return value{0, false}
+		} else if op == "/" {
+			return value{l.n / r.n, false}
+		} else {
+			return value{l.n % r.n, false}
+		}
+	case "+":
+		return value{l.n + r.n, unsigned}
+	case "-":
+		return value{l.n - r.n, unsigned}
+	case "<<", ">>":
+		// the result has the type of the left operand
+		n := r.n
+		if !r.unsigned && n < 0 {
+			n = -n
+			if op == "<<" {
+				op = ">>"
+			} else {
+				op = "<<"
+			}
+		}
+		if uint64(n) >= 64 {
+			if op == ">>" && !l.unsigned && l.n < 0 {
+				return value{-1, false}
+			}
+			return value{0, l.unsigned}
+		}
+		if op == "<<" {
+			return value{l.n << n, l.unsigned}
+		} else if l.unsigned {
+			return value{int64(a >> n), true}
+		} else {
+			return value{l.n >> n, false}
+		}
+	case "<", ">", "<=", ">=":
+		var less, greater bool
+		if unsigned {
+			less, greater = a < b, a > b
+		} else {
+			less, greater = l.n < r.n, l.n > r.n
+		}
+		switch op {
+		case "<":
+			return boolean(less)
+		case ">":
+			return boolean(greater)
+		case "<=":
+			return boolean(!greater)
+		default:
+			return boolean(!less)
+		}
+	case "==":
+		return boolean(l.n == r.n)
+	case "!=":
+		return boolean(l.n != r.n)
+	case "&":
+		return value{l.n & r.n, unsigned}
+	case "^":
+		return value{l.n ^ r.n, unsigned}
+	default:
+		return value{l.n | r.n, unsigned}
+	}
+}
+
+// decimal, octal and hexadecimal constants with the u, l and ll suffixes,
+// and in C23 binary ones and digits separated by '
+func (e *evaluator) integer(lit string) value {
+	s := strings.ToLower(lit)
+	base := 10
+
+	switch {
+	case strings.HasPrefix(s, "0x"):
+		base, s = 16, s[2:]
+	case strings.HasPrefix(s, "0b") && e.p.opts.Std == C23:
+		base, s = 2, s[2:]
+	case strings.HasPrefix(s, "0"):
+		base = 8
+	}
+
+	if base != 16 && strings.ContainsAny(s, ".e") ||
+		base == 16 && strings.ContainsAny(s, ".p") {
+		e.error("floating constant in preprocessor expression")
+		return value{}
+	}
+
+	end := len(s)
+	for end > 0 && (s[end-1] == 'u' || s[end-1] == 'l') {
+		end--
+	}
+	digits, suffix := s[:end], lit[len(lit)-(len(s)-end):]
+
+	unsigned := false
+	switch strings.ToLower(suffix) {
+	case "", "l", "ll":
+		// ll and LL are valid, but not mixed case
+		if suffix == "lL" || suffix == "Ll" {
+			e.error("invalid suffix \"%s\" on integer constant", suffix)
+			return value{}
+		}
+	case "u", "ul", "lu", "ull", "llu":
+		unsigned = true
+		if strings.Contains(suffix, "lL") || strings.Contains(suffix, "Ll") {
+			e.error("invalid suffix \"%s\" on integer constant", suffix)
+			return value{}
+		}
+	default:
+		e.error("invalid suffix \"%s\" on integer constant", suffix)
+		return value{}
+	}
+
+	// only the lexer of C23 lets a separator into a pp-number, it has to
+	// be between digits
+	if strings.HasPrefix(digits, "'") || strings.HasSuffix(digits, "'") {
+		e.error("invalid integer constant %s", lit)
+		return value{}
+	}
+	digits = strings.ReplaceAll(digits, "'", "")
+
+	if digits == "" && base != 8 {
+		e.error("invalid integer constant %s", lit)
+		return value{}
+	} else if digits == "" {
+		digits = "0"
+	}
+
+	n, err := strconv.ParseUint(digits, base, 64)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			e.error("integer constant %s is too large", lit)
+		} else {
+			e.error("invalid integer constant %s", lit)
+		}
+		return value{}
+	}
+
+	// too large for intmax_t, so it can only be represented as uintmax_t
+	if n > math.MaxInt64 {
+		unsigned = true
+	}
+
+	return value{int64(n), unsigned}
+}
+
+// character constants have type int, a multi-character constant takes one
+// byte per character with the first one being the most significant
+func (e *evaluator) char(lit string) value {
+	prefix := lit[:strings.IndexByte(lit, '\'')]
+	body := lit[len(prefix)+1 : len(lit)-1]
+
+	chars := []int64{}
+	for len(body) > 0 {
+		c, n, ok := unescape(body, prefix == "" || prefix == "u8")
+		if !ok {
+			e.error("invalid escape sequence in %s", lit)
+			return value{}
+		}
+		chars = append(chars, c)
+		body = body[n:]
+	}
+
+	if len(chars) == 0 {
+		e.error("empty character constant")
+		return value{}
+	}
+
+	if prefix != "" {
+		// the value of a wide character constant is the last character
+		return value{chars[len(chars)-1], false}
+	}
+	if len(chars) == 1 {
+		// plain char is signed
+		return value{int64(int8(chars[0])), false}
+	}
+
+	var n int32
+	for _, c := range chars {
+		n = n<<8 | int32(c&0xff)
+	}
+	return value{int64(n), false}
+}
+
+var escapes = map[byte]int64{
+	'\'': '\'',
+	'"':  '"',
+	'?':  '?',
+	'\\': '\\',
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+}
+
+// decodes the first character of s, which is a single byte of a multi-byte
+// character when bytes is set, returning its value and the length it took
+func unescape(s string, bytes bool) (int64, int, bool) {
+	if s[0] != '\\' {
+		if bytes {
+			return int64(s[0]), 1, true
+		}
+		r, n := utf8.DecodeRuneInString(s)
+		return int64(r), n, true
+	}
+
+	if len(s) < 2 {
+		return 0, 0, false
+	}
+	if c, ok := escapes[s[1]]; ok {
+		return c, 2, true
+	}
+
+	switch c := s[1]; {
+	case c >= '0' && c <= '7':
+		n := 1
+		for n < 4 && n < len(s) && s[n] >= '0' && s[n] <= '7' {
+			n++
+		}
+		v, _ := strconv.ParseInt(s[1:n], 8, 64)
+		return v, n, true
+	case c == 'x', c == 'u', c == 'U':
+		n := 2
+		for n < len(s) && isHex(s[n]) {
+			n++
+		}
+		if c == 'u' && n != 6 || c == 'U' && n != 10 {
+			return 0, 0, false
+		}
+		v, err := strconv.ParseUint(s[2:n], 16, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		return int64(v), n, true
+	}
+
+	return 0, 0, false
+}
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+func boolean(b bool) value {
+	if b {
+		return value{1, false}
+	}
+	return value{0, false}
+}
+func (e *evaluator) prec() uint {
+	if e.pos >= len(e.toks) {
+		return lowest
+	}
+	switch tok := e.curr(); tok.Type {
+	case PUNCT, COMMA:
+		return prec[tok.Literal]
+	}
+	return lowest
+}
+func (e *evaluator) curr() Token {
+	return e.toks[e.pos]
+}
+func (e *evaluator) error(format string, rest ...any) {
+	if !e.failed {
+		e.failed = true
+		e.p.error(format, rest...)
+	}
+}
@@ -0,0 +1,152 @@
+package cpp
+
+import "testing"
+
+func TestEvaluate(t *testing.T) {
+	tt := []struct {
+		expr string
+		want int64
+	}{
+		{"1", 1},
+		{"0", 0},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 / 3", 3},
+		{"10 % 3", 1},
+		{"-10 / 3", -3},
+		{"1 - 2 - 3", -4},
+		{"1 << 4 >> 2", 4},
+		{"-1 >> 1", -1},
+		{"~0", -1},
+		{"!0 + !5", 1},
+		{"- -1", 1},
+		{"+1", 1},
+		{"1 < 2 == 1", 1},
+		{"2 <= 1", 0},
+		{"3 > 2 > 1", 0},
+		{"3 >= 3", 1},
+		{"1 != 2", 1},
+		{"6 & 3 ^ 1 | 8", 11},
+		{"1 && 0 || 1", 1},
+		{"0 || 0", 0},
+		{"1 ? 2 : 3", 2},
+		{"0 ? 2 : 0 ? 3 : 4", 4},
+		{"1 ? 0 ? 2 : 3 : 4", 3},
+		{"(1, 2)", 2},
+		{"0x10 + 010", 24},
+		{"10u + 10L + 10ull + 10LL + 10lu", 50},
+		{"-1 < 0u", 0},
+		{"-1 > 0u", 1},
+		{"0xffffffffffffffff == -1", 1},
+		{"18446744073709551615 > 0", 1},
+		{"9223372036854775807 + 0", 9223372036854775807},
+		{"'a'", 97},
+		{"'\\n'", 10},
+		{"'\\0'", 0},
+		{"'\\377'", -1},
+		{"'\\x41'", 65},
+		{"'\\''", 39},
+		{"'ab'", 24930},
+		{"L'\\377'", 255},
+		{"u'\\u00e9'", 233},
+		{"undefined_identifier", 0},
+		{"undefined + 1", 1},
+		{"0 && 1 / 0", 0},
+		{"1 || 1 % 0", 1},
+		{"0 ? 1 / 0 : 2", 2},
+		{"1+2*3", 7},
+		{"10-1-1", 8},
+		{"(1+1)==2", 1},
+	}
+
+	for _, test := range tt {
+		p := NewParser(New(""))
+		v, ok := p.evaluate(tokenize(test.expr))
+
+		for _, e := range p.err {
+			t.Errorf("%s: %s", test.expr, e.Error())
+		}
+		if ok && v.n != test.want {
+			t.Errorf("%s: want=%d, got=%d", test.expr, test.want, v.n)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	tt := []string{
+		"1 / 0",
+		"1 % 0",
+		"(-9223372036854775807 - 1) / -1",
+		"1 +",
+		"(1",
+		"1 2",
+		"1 ? 2",
+		"1.0",
+		"1e5",
+		"0x1p3",
+		"1x",
+		"1lL",
+		"99999999999999999999",
+		"08",
+		"''",
+		"\"a\"",
+		"1 = 1",
+		")",
+		// only C23 has these
+		"0b11",
+		"1'000",
+	}
+
+	for _, expr := range tt {
+		p := NewParser(New(""))
+		if _, ok := p.evaluate(tokenize(expr)); ok || len(p.err) == 0 {
+			t.Errorf("no error reported for %q", expr)
+		}
+	}
+}
+
+func TestEvaluateC23(t *testing.T) {
+	opts := Options{Std: C23}
+	src := "#if 0b11 == 3 && 1'000'000 == 1000000\na\n#endif\n"
+	check(t, NewParserOptions(New(src), opts), "\na\n\n")
+	check(t, NewParserOptions(New("#if 1'000 == 1000 // x'y\na\n#endif\n"), opts), "\na\n\n")
+
+	errs := []string{
+		"#if 1'u\n#endif\n",
+		"#if 0x'1\n#endif\n",
+		"#if 0b12\n#endif\n",
+	}
+	for _, src := range errs {
+		if _, err := NewParserOptions(New(src), opts).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+}
+
+func TestDefined(t *testing.T) {
+	tt := []Pair{
+		{"#define A\n#if defined A\na\n#endif\n", "\n\na\n\n"},
+		{"#define A\n#if defined(A) && !defined ( B )\na\n#endif\n", "\n\na\n\n"},
+		{"#if defined A || defined(B)\na\n#endif\n", "\n\n\n"},
+		// the operand is not expanded
+		{"#define A B\n#if defined A\na\n#endif\n", "\n\na\n\n"},
+		{"#define A\n#define D defined(A)\n#if D\na\n#endif\n", "\n\n\na\n\n"},
+		{"#define A 2\n#define B A + 1\n#if B == 3\na\n#endif\n", "\n\n\na\n\n"},
+		{"#define f(x) x * 2\n#if f(3) == 6\na\n#endif\n", "\n\na\n\n"},
+		{"#define N 4\n#if N-1==3&&N+1>4\na\n#endif\n", "\n\na\n\n"},
+	}
+
+	checkAll(t, tt)
+
+	errs := []string{
+		"#if defined\n#endif\n",
+		"#if defined(\n#endif\n",
+		"#if defined(A\n#endif\n",
+		"#define defined\n",
+	}
+	for _, src := range errs {
+		if _, err := NewParser(New(src)).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+}
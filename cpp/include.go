@@ -0,0 +1,304 @@
+package cpp
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// the reading state of a file suspended by #include
+type file struct {
+	name     string
+	presumed string
+	l        *Lexer
+	curr     Token
+	next     Token
+	delta    int
+	system   bool
+	found    int
+	guard    guard
+	// number of conditionals open when the included file was entered
+	conds int
+}
+
+// how much of a file matched the include guard idiom so far:
+//
+//	#ifndef X
+//	...
+//	#endif
+//
+// with nothing but whitespace around it
+type guard struct {
+	state uint
+	name  string
+	// index of the guarding section on the conditional stack
+	cond int
+}
+
+const (
+	guardStart = iota
+	guardOpen
+	guardClosed
+	guardNone
+)
+
+// '#' "include" pp-token+ '\n', the file is entered by Expand after the
+// rest of the line has been consumed. #include_next searches the path from
+// the directory after the one the current file was found in.
+func (p *Parser) include(directive string) {
+	p.skipWS()
+
+	var name string
+	var angled bool
+
+	switch {
+	case p.is(HEADER):
+		name, angled = strings.Trim(p.curr.Literal, "<>"), true
+		p.adv()
+		p.extraTokens(directive)
+	case p.is(STRING) && strings.HasPrefix(p.curr.Literal, `"`):
+		name = strings.Trim(p.curr.Literal, `"`)
+		p.adv()
+		p.extraTokens(directive)
+	default:
+		// computed include: the line is expanded, and must then match
+		// one of the two forms
+		toks := []Token{}
+		for !p.is(EOF) && !p.is(NEWLINE) {
+			toks = append(toks, p.curr)
+			p.adv()
+		}
+
+		var ok bool
+		if name, angled, ok = headerName(trimWS(p.expand(toks))); !ok {
+			p.error("#%s expects \"FILENAME\" or <FILENAME>", directive)
+			return
+		}
+	}
+
+	if name == "" {
+		p.error("empty filename in #%s", directive)
+		return
+	}
+	if len(p.files) >= p.opts.MaxIncludeDepth {
+		p.error("#include nested depth %d exceeds maximum of %d",
+			len(p.files)+1, p.opts.MaxIncludeDepth)
+		return
+	}
+
+	h, ok := p.find(name, angled, directive == "include_next")
+	if !ok {
+		p.error("%s: No such file or directory", name)
+		return
+	}
+	full := h.name
+	p.depend(full, h.system)
+
+	if macro, ok := p.guards[full]; p.once[full] || ok && p.macros[macro] != nil {
+		p.skipped++
+		return
+	}
+
+	src, err := fs.ReadFile(p.opts.FS, full)
+	if err != nil {
+		p.error("%s: %s", name, err)
+		return
+	}
+
+	p.included = &file{name: full, l: p.lexer(string(src)), system: h.system, found: h.found}
+}
+
+// __has_include ( header-name ) and __has_include_next, the operand is
+// taken from the queue and only expanded when it is not already a header
+// name
+func (p *Parser) hasInclude(operator string) Token {
+	i := nextSignificant(p.queue, 0)
+	if i >= len(p.queue) || p.queue[i].Literal != "(" {
+		p.error("missing '(' before \"%s\" operand", operator)
+		return Token{Type: PPNUM, Literal: "0"}
+	}
+
+	depth := 0
+	for j := i + 1; j < len(p.queue); j++ {
+		switch tok := p.queue[j]; {
+		case tok.Literal == "(":
+			depth++
+		case tok.Type == RPAREN && depth > 0:
+			depth--
+		case tok.Type == RPAREN:
+			operand := trimWS(p.queue[i+1 : j])
+			p.queue = p.queue[j+1:]
+			return p.hasHeader(operator, operand)
+		}
+	}
+
+	p.queue = nil
+	p.error("missing ')' after \"%s\" operand", operator)
+	return Token{Type: PPNUM, Literal: "0"}
+}
+
+func (p *Parser) hasHeader(operator string, operand []Token) Token {
+	name, angled, ok := headerName(operand)
+	if !ok {
+		name, angled, ok = headerName(trimWS(p.expand(operand)))
+	}
+	if !ok || name == "" {
+		p.error("operator \"%s\" requires a header-name", operator)
+		return Token{Type: PPNUM, Literal: "0"}
+	}
+
+	if _, found := p.find(name, angled, operator == "__has_include_next"); found {
+		return Token{Type: PPNUM, Literal: "1"}
+	}
+	return Token{Type: PPNUM, Literal: "0"}
+}
+
+// number of #include directives that did not read their file again since
+// it was guarded or marked with #pragma once
+func (p *Parser) SkippedIncludes() int {
+	return p.skipped
+}
+
+// anything outside of the guarding section means there is no guard
+func (p *Parser) unguarded() {
+	if p.guard.state != guardOpen {
+		p.guard.state = guardNone
+	}
+}
+
+// #elif and #else make a section unfit as a guard
+func (p *Parser) unguardedBy(cond int) {
+	if p.guard.state == guardOpen && p.guard.cond == cond {
+		p.guard.state = guardNone
+	}
+}
+
+// the header name spelled by the tokens of a computed include
+func headerName(toks []Token) (string, bool, bool) {
+	if len(toks) == 1 && toks[0].Type == STRING &&
+		strings.HasPrefix(toks[0].Literal, `"`) {
+		return strings.Trim(toks[0].Literal, `"`), false, true
+	}
+
+	last := len(toks) - 1
+	if len(toks) < 2 || toks[0].Literal != "<" || toks[last].Literal != ">" {
+		return "", false, false
+	}
+
+	return join(toks[1:last]), true, true
+}
+
+// a header as found on the search path
+type header struct {
+	name   string
+	system bool
+	// the position after the directory it was found in, a header found
+	// next to the including file counts as found where that one was
+	found int
+}
+
+// a quoted name is looked up next to the including file, then in the
+// quote directories, and last like an angled name in the system ones. The
+// search for next continues after the directory the current file was found
+// in, or is a plain one when it was not found on the search path.
+func (p *Parser) find(name string, angled, next bool) (header, bool) {
+	if p.opts.FS == nil {
+		return header{}, false
+	}
+
+	// the search path, the quote directories followed by the system ones
+	dirs := append(append([]string{}, p.opts.QuoteDirs...), p.opts.SystemDirs...)
+	quoted := len(p.opts.QuoteDirs)
+
+	first := 0
+	if next && p.found > 0 {
+		first = p.found
+	} else if angled {
+		first = quoted
+	} else if h, ok := p.lookup(path.Dir(p.name), name); ok {
+		h.found = p.found
+		return h, true
+	}
+
+	for i := first; i < len(dirs); i++ {
+		if h, ok := p.lookup(dirs[i], name); ok {
+			h.system, h.found = i >= quoted, i+1
+			return h, true
+		}
+	}
+
+	return header{}, false
+}
+
+// the names FS accepts are up to it, an fs.FS rejects anything but valid
+// paths while the file system of the command takes host paths as well
+func (p *Parser) lookup(dir, name string) (header, bool) {
+	full := path.Join(dir, name)
+	if info, err := fs.Stat(p.opts.FS, full); err != nil || info.IsDir() {
+		return header{}, false
+	}
+	return header{name: full}, true
+}
+
+// suspends the current file and continues with f
+func (p *Parser) enter(f *file) {
+	p.files = append(p.files, file{
+		name:     p.name,
+		presumed: p.presumed,
+		l:        p.l,
+		curr:     p.curr,
+		next:     p.next,
+		delta:    p.delta,
+		system:   p.system,
+		found:    p.found,
+		guard:    p.guard,
+		conds:    len(p.conds),
+	})
+
+	p.name, p.presumed, p.l = f.name, f.name, f.l
+	p.delta, p.system, p.found = 0, f.system, f.found
+	p.guard = guard{}
+	p.curr, p.next = Token{}, Token{}
+	p.adv()
+	p.adv()
+}
+
+// returns to the including file at the end of an included one, false when
+// the main file is over
+func (p *Parser) leave() bool {
+	if len(p.files) == 0 {
+		return false
+	}
+	f := p.files[len(p.files)-1]
+	p.files = p.files[:len(p.files)-1]
+
+	// an if-section can not span files
+	p.closeConds(f.conds)
+
+	if p.guard.state == guardClosed {
+		p.guards[p.name] = p.guard.name
+	}
+
+	p.name, p.presumed, p.l = f.name, f.presumed, f.l
+	p.delta, p.system, p.found = f.delta, f.system, f.found
+	p.guard = f.guard
+	p.curr, p.next = f.curr, f.next
+
+	return true
+}
+
+// number of conditionals open when the current file was entered
+func (p *Parser) condBase() int {
+	if len(p.files) == 0 {
+		return 0
+	}
+	return p.files[len(p.files)-1].conds
+}
+
+func (p *Parser) closeConds(base int) {
+	for _, c := range p.conds[base:] {
+		p.where = c.line
+		p.error("unterminated #%s", c.directive)
+	}
+	p.conds = p.conds[:base]
+}
@@ -0,0 +1,196 @@
+package cpp
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.c":           {Data: []byte("")},
+		"a.h":              {Data: []byte("int a;\n")},
+		"dir/b.h":          {Data: []byte("#include \"c.h\"\nint b;\n")},
+		"dir/c.h":          {Data: []byte("int c;\n")},
+		"include/d.h":      {Data: []byte("int d;\n")},
+		"sys/stdio.h":      {Data: []byte("int printf();\n")},
+		"sys/a.h":          {Data: []byte("int sys_a;\n")},
+		"macro.h":          {Data: []byte("#define M 1\n")},
+		"noeol.h":          {Data: []byte("x")},
+		"include/dir/e.h":  {Data: []byte("#include \"../d.h\"\n")},
+		"include/nested.h": {Data: []byte("#include <stdio.h>\n")},
+	}
+	opts := Options{
+		Filename:   "main.c",
+		FS:         fsys,
+		QuoteDirs:  []string{"include"},
+		SystemDirs: []string{"sys"},
+	}
+
+	tt := []Pair{
+		{"#include \"a.h\"\n", "\nint a;\n"},
+		{"#include <a.h>\n", "\nint sys_a;\n"},
+		{"#include <stdio.h>\nx\n", "\nint printf();\nx\n"},
+		{"#include \"dir/b.h\"\n", "\n\nint c;\nint b;\n"},
+		{"#include \"d.h\"\n", "\nint d;\n"},
+		{"#include \"dir/e.h\"\n", "\n\nint d;\n"},
+		{"#include \"nested.h\"\n", "\n\nint printf();\n"},
+		{"#include \"macro.h\"\nM\n", "\n\n1\n"},
+		{"#include \"noeol.h\"\ny", "\nxy"},
+		{"#define H \"a.h\"\n#include H\n", "\n\nint a;\n"},
+		{"#define H <stdio.h>\n#include H\n", "\n\nint printf();\n"},
+		{"#define S(x) #x\n#include S(a.h)\n", "\n\nint a;\n"},
+		{"#if 0\n#include \"missing.h\"\n#endif\n", "\n\n\n"},
+	}
+
+	for _, test := range tt {
+		check(t, NewParserOptions(New(test.input), opts), test.output)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"self.h":   {Data: []byte("#include \"self.h\"\n")},
+		"open.h":   {Data: []byte("#if 1\n")},
+		"close.h":  {Data: []byte("#endif\n")},
+		"broken.h": {Data: []byte("#define f(a) a\nf(\n")},
+	}
+	opts := Options{FS: fsys, MaxIncludeDepth: 10}
+
+	tt := []string{
+		"#include \"missing.h\"\n",
+		"#include <self.h>\n",
+		"#include\n",
+		"#include x\n",
+		"#include \"\"\n",
+		"#include \"open.h\"\n#endif\n",
+		"#if 1\n#include \"close.h\"\n",
+		"#include \"broken.h\"\n)\n",
+		"#include \"self.h\"\n",
+		"#include \"self.h\" x\n",
+	}
+
+	for _, src := range tt {
+		p := NewParserOptions(New(src), opts)
+		if _, err := p.Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+
+	p := NewParserOptions(New("#include \"self.h\"\n"), opts)
+	_, err := p.Expand()
+	if len(err) != 1 || !strings.Contains(err[0].Error(), "nested depth 11") {
+		t.Errorf("expected the include depth to be exceeded once, got %v", err)
+	}
+
+	p = NewParser(New("#include \"a.h\"\n"))
+	if _, err := p.Expand(); len(err) == 0 {
+		t.Errorf("include without a file system not reported")
+	}
+}
+
+func TestIncludeGuards(t *testing.T) {
+	fsys := fstest.MapFS{
+		"guarded.h": {Data: []byte("\n/* comment */\n#ifndef G\n#define G\nint g;\n#endif\n\n")},
+		"once.h":    {Data: []byte("#pragma once\nint o;\n")},
+		"plain.h":   {Data: []byte("int p;\n")},
+		"else.h":    {Data: []byte("#ifndef E\n#define E\nint e;\n#else\n#endif\n")},
+		"after.h":   {Data: []byte("#ifndef A\n#define A\n#endif\nint a;\n")},
+		"before.h":  {Data: []byte("int b;\n#ifndef B\n#define B\n#endif\n")},
+		"ifdef.h":   {Data: []byte("#ifdef I\n#else\n#define I\n#endif\n")},
+		"nested.h":  {Data: []byte("#ifndef N\n#define N\n#if 1\n#endif\n#endif\n")},
+	}
+	opts := Options{FS: fsys}
+
+	tt := []struct {
+		input   string
+		skipped int
+	}{
+		{"#include \"guarded.h\"\n#include \"guarded.h\"\n#include \"guarded.h\"\n", 2},
+		{"#include \"once.h\"\n#include \"once.h\"\n", 1},
+		{"#include \"plain.h\"\n#include \"plain.h\"\n", 0},
+		{"#include \"else.h\"\n#include \"else.h\"\n", 0},
+		{"#include \"after.h\"\n#include \"after.h\"\n", 0},
+		{"#include \"before.h\"\n#include \"before.h\"\n", 0},
+		{"#include \"ifdef.h\"\n#include \"ifdef.h\"\n", 0},
+		{"#include \"nested.h\"\n#include \"nested.h\"\n", 1},
+		{"#include \"guarded.h\"\n#undef G\n#include \"guarded.h\"\n", 0},
+	}
+
+	for _, test := range tt {
+		p := NewParserOptions(New(test.input), opts)
+		p.Expand()
+		if n := p.SkippedIncludes(); n != test.skipped {
+			t.Errorf("expected %d skipped includes, got %d for %q",
+				test.skipped, n, test.input)
+		}
+	}
+
+	p := NewParserOptions(New("#include \"guarded.h\"\n#include \"guarded.h\"\ng\n"), opts)
+	check(t, p, "\n\n \n\n\nint g;\n\n\n\ng\n")
+}
+
+func TestIncludeNext(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.c":          {Data: []byte("")},
+		"a/limits.h":      {Data: []byte("a\n#include_next <limits.h>\n")},
+		"b/limits.h":      {Data: []byte("b\n#include_next <limits.h>\n")},
+		"c/limits.h":      {Data: []byte("c\n")},
+		"b/wrap.h":        {Data: []byte("#include \"inner.h\"\n")},
+		"b/inner.h":       {Data: []byte("#include_next <wrap.h>\n")},
+		"c/wrap.h":        {Data: []byte("wrapped\n")},
+		"a/has.h":         {Data: []byte("#if __has_include_next(<has.h>)\n#include_next <has.h>\n#endif\n")},
+		"c/has.h":         {Data: []byte("#if __has_include_next(<has.h>)\nnext\n#else\nlast\n#endif\n")},
+		"b/threads.h":     {Data: []byte("")},
+		"local.h":         {Data: []byte("local\n")},
+		"c/local.h":       {Data: []byte("c local\n")},
+		"a/sub/nested.h":  {Data: []byte("#include_next <sub/nested.h>\n")},
+		"c/sub/nested.h":  {Data: []byte("c nested\n")},
+		"a/sub/missing.h": {Data: []byte("#include_next <sub/missing.h>\n")},
+	}
+	opts := Options{
+		Filename:   "main.c",
+		FS:         fsys,
+		QuoteDirs:  []string{"a"},
+		SystemDirs: []string{"b", "c"},
+	}
+
+	tt := []Pair{
+		{"#include <limits.h>\n", "\nb\n\nc\n"},
+		{"#include \"limits.h\"\n", "\na\n\nb\n\nc\n"},
+		// a header found next to the including one continues after the
+		// directory that one was found in
+		{"#include <wrap.h>\n", "\n\n\nwrapped\n"},
+		{"#include \"has.h\"\n", "\n\n\n\n\n\nlast\n\n\n"},
+		{"#include \"sub/nested.h\"\n", "\n\nc nested\n"},
+		// from the main file it is a plain #include
+		{"#include_next \"local.h\"\n", "\nlocal\n"},
+		{"#if __has_include(<threads.h>)\nyes\n#endif\n", "\nyes\n\n"},
+		{"#if __has_include(<none.h>)\nyes\n#endif\n", "\n\n\n"},
+		{"#if __has_include(\"local.h\") && __has_include( \"c/limits.h\" )\nyes\n#endif\n", "\nyes\n\n"},
+		{"#define T <threads.h>\n#if __has_include(T)\nyes\n#endif\n", "\n\nyes\n\n"},
+		{"#if defined __has_include && defined(__has_include_next)\nyes\n#endif\n", "\nyes\n\n"},
+		{"#ifdef __has_include\nyes\n#endif\n", "\nyes\n\n"},
+		{"#if __has_include_next(<c/limits.h>)\nyes\n#endif\n", "\n\n\n"},
+	}
+
+	for _, test := range tt {
+		check(t, NewParserOptions(New(test.input), opts), test.output)
+	}
+
+	errs := []string{
+		"#include \"sub/missing.h\"\n",
+		"#if __has_include\n#endif\n",
+		"#if __has_include(\n#endif\n",
+		"#if __has_include(x)\n#endif\n",
+		"#if __has_include()\n#endif\n",
+		"__has_include(<a.h>)\n",
+		"#include_next\n",
+	}
+	for _, input := range errs {
+		p := NewParserOptions(New(input), opts)
+		if _, err := p.Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", input)
+		}
+	}
+}
@@ -1,62 +1,138 @@
 package cpp
 
 import (
-	"fmt"
+	"sort"
 	"unicode"
+	"unicode/utf8"
 )
 
 var kw_map = map[string]uint{
-	"define":  DEFINE,
-	"elif":    ELIF,
-	"else":    ELSE,
-	"error":   ERROR,
-	"if":      IF,
-	"ifdef":   IFDEF,
-	"ifndef":  IFNDEF,
-	"include": INCLUDE,
-	"line":    LINE,
-	"pragma":  PRAGMA,
-	"undef":   UNDEF,
+	"define":       DEFINE,
+	"elif":         ELIF,
+	"else":         ELSE,
+	"endif":        ENDIF,
+	"error":        ERROR,
+	"if":           IF,
+	"ifdef":        IFDEF,
+	"ifndef":       IFNDEF,
+	"include":      INCLUDE,
+	"include_next": INCLUDE_NEXT,
+	"line":         LINE,
+	"pragma":       PRAGMA,
+	"undef":        UNDEF,
 }
 
 var Tmap = map[uint]string{
-	EOF:        "EOF",
-	DEFINE:     "define",
-	ELIF:       "elif",
-	ELSE:       "else",
-	ERROR:      "error",
-	IF:         "if",
-	IFDEF:      "ifdef",
-	IFNDEF:     "ifndef",
-	INCLUDE:    "include",
-	LINE:       "line",
-	PRAGMA:     "pragma",
-	UNDEF:      "undef",
-	HEADER:     "HEADER",
-	PPNUM:      "PPNUM",
-	HASH:       "#",
-	NEWLINE:    `\n`,
-	WS:         "WS",
-	COMMA:      ",",
-	PUNCT:      "PUNCT",
-	ELLIP:      "...",
-	IDENT:      "ident",
-	CHAR_CONST: "char_const",
-	STRING:     "string",
+	EOF:          "EOF",
+	ERR:          "ERR",
+	DEFINE:       "define",
+	ELIF:         "elif",
+	ELSE:         "else",
+	ENDIF:        "endif",
+	ERROR:        "error",
+	IF:           "if",
+	IFDEF:        "ifdef",
+	IFNDEF:       "ifndef",
+	INCLUDE:      "include",
+	INCLUDE_NEXT: "include_next",
+	LINE:         "line",
+	PRAGMA:       "pragma",
+	UNDEF:        "undef",
+	HEADER:       "HEADER",
+	PPNUM:        "PPNUM",
+	HASH:         "#",
+	HASHHASH:     "##",
+	NEWLINE:      `\n`,
+	WS:           "WS",
+	COMMA:        ",",
+	PUNCT:        "PUNCT",
+	OTHER:        "OTHER",
+	ELLIP:        "...",
+	IDENT:        "ident",
+	CHAR_CONST:   "char_const",
+	STRING:       "string",
 }
 
 type Lexer struct {
 	src     []rune
 	sp      int
 	keyword map[string]uint
+	state   uint
+	// ' separates the digits of pp-numbers, as in C23
+	c23 bool
+	// the original source, the offset in it of every character of src
+	// and one past the end, and where each of its lines starts
+	orig  string
+	off   []int
+	lines []int
 }
 
+// header names are only recognized as the operand of #include, the lexer
+// follows how far into such a directive the line is
+const (
+	lineStart = iota
+	sawHash
+	sawInclude
+	inLine
+)
+
 func New(src string) *Lexer {
-	l := &Lexer{src: []rune(pre(src)), keyword: kw_map}
+	return newLexer(src, false)
+}
+
+// a lexer for the given language mode, which phase 3 has to know already
+func newLexer(src string, c23 bool) *Lexer {
+	l := &Lexer{keyword: kw_map, orig: src, lines: []int{0}, c23: c23}
+
+	t := translate(src, c23)
+	for i := 0; i < len(t.buf); {
+		r, n := utf8.DecodeRune(t.buf[i:])
+		l.src = append(l.src, r)
+		l.off = append(l.off, t.off[i])
+		i += n
+	}
+	l.off = append(l.off, len(src))
+
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			l.lines = append(l.lines, i+1)
+		}
+	}
+
 	return l
 }
 
 func (l *Lexer) Lex() Token {
+	start := l.sp
+	tok := l.lex()
+	tok.Pos = l.position(l.off[start])
+
+	switch {
+	case tok.Type == NEWLINE:
+		l.state = lineStart
+	case tok.Type == WS:
+	case tok.Type == HASH && l.state == lineStart:
+		l.state = sawHash
+	case (tok.Type == INCLUDE || tok.Type == INCLUDE_NEXT) && l.state == sawHash:
+		l.state = sawInclude
+	default:
+		l.state = inLine
+	}
+
+	return tok
+}
+
+// the line and column of an offset in the original source
+func (l *Lexer) position(off int) Pos {
+	line := sort.Search(len(l.lines), func(i int) bool {
+		return l.lines[i] > off
+	})
+	col := utf8.RuneCountInString(l.orig[l.lines[line-1]:off]) + 1
+
+	return Pos{Offset: off, Line: line, Col: col}
+}
+
+func (l *Lexer) lex() Token {
 	for !l.isend() {
 		c := l.peek()
 
@@ -73,6 +149,9 @@ func (l *Lexer) Lex() Token {
 			l.adv()
 			return tok(NEWLINE, "\n")
 		case '#':
+			if p, matched := l.oneOf("##"); matched {
+				return tok(HASHHASH, p)
+			}
 			l.adv()
 			return tok(HASH, "#")
 		case ',':
@@ -92,9 +171,16 @@ func (l *Lexer) Lex() Token {
 				l.adv()
 				return l.ppnum(true)
 			}
-		case '?', ';', ':', '{', '}', '(', '[', ']', '~':
+		case '?', ';', '{', '}', '(', '[', ']', '~':
 			l.adv()
 			return tok(PUNCT, string(c))
+		// digraphs keep their spelling, which only matters to # and ##
+		case ':':
+			if p, matched := l.oneOf(":>"); matched {
+				return tok(PUNCT, p)
+			}
+			l.adv()
+			return tok(PUNCT, ":")
 		case '+':
 			if p, matched := l.oneOf("++", "+="); matched {
 				return tok(PUNCT, p)
@@ -117,7 +203,11 @@ func (l *Lexer) Lex() Token {
 				return tok(PUNCT, "*")
 			}
 		case '%':
-			if p, matched := l.oneOf("%="); matched {
+			if p, matched := l.oneOf("%:%:"); matched {
+				return tok(HASHHASH, p)
+			} else if p, matched := l.oneOf("%:"); matched {
+				return tok(HASH, p)
+			} else if p, matched := l.oneOf("%=", "%>"); matched {
 				return tok(PUNCT, p)
 			} else {
 				l.adv()
@@ -131,7 +221,10 @@ func (l *Lexer) Lex() Token {
 				return tok(PUNCT, "/")
 			}
 		case '<':
-			if p, matched := l.oneOf("<<=", "<<", "<="); matched {
+			if l.state == sawInclude {
+				return l.header()
+			}
+			if p, matched := l.oneOf("<<=", "<<", "<=", "<:", "<%"); matched {
 				return tok(PUNCT, p)
 			} else {
 				l.adv()
@@ -182,7 +275,9 @@ func (l *Lexer) Lex() Token {
 		case '_':
 			return l.word()
 		case '"':
-			return l.string()
+			return l.quoted('"', STRING, "string")
+		case '\'':
+			return l.quoted('\'', CHAR_CONST, "character constant")
 
 		default:
 			// phase 3.2: non newline ws are collapsed into one space character
@@ -191,10 +286,7 @@ func (l *Lexer) Lex() Token {
 				return tok(WS, " ")
 			} else {
 				l.adv()
-				return Token{
-					Type:    ERR,
-					Literal: fmt.Sprintf("unknown character %q", c),
-				}
+				return tok(OTHER, string(c))
 			}
 		}
 	}
@@ -213,9 +305,24 @@ func (l *Lexer) ppnum(dot_beginning bool) Token {
 
 	for !l.isend() {
 		switch c := l.peek(); c {
-		case 'w', 'e', 'E', 'p', 'P', '.', '+', '-':
+		case 'w', 'e', 'E', 'p', 'P', '.':
 			l.adv()
 			continue
+		case '\'':
+			// a separator is followed by a digit or a nondigit
+			if l.c23 && l.sp+1 < len(l.src) &&
+				(unicode.IsDigit(l.src[l.sp+1]) || unicode.IsLetter(l.src[l.sp+1])) {
+				l.adv()
+				l.adv()
+				continue
+			}
+		case '+', '-':
+			// a sign only belongs to an exponent
+			switch l.src[l.sp-1] {
+			case 'e', 'E', 'p', 'P':
+				l.adv()
+				continue
+			}
 		default:
 			if unicode.IsDigit(c) || unicode.IsLetter(c) {
 				l.adv()
@@ -230,6 +337,26 @@ func (l *Lexer) ppnum(dot_beginning bool) Token {
 	return tok(PPNUM, string(l.src[start:end]))
 }
 
+// header-name: '<' [^\n>]* '>'
+func (l *Lexer) header() Token {
+	start := l.sp
+
+	for {
+		l.adv()
+		if l.isend() || l.peek() == '\n' {
+			return Token{
+				Type:    ERR,
+				Literal: "missing terminating > character",
+			}
+		} else if l.peek() == '>' {
+			break
+		}
+	}
+	l.adv()
+
+	return tok(HEADER, string(l.src[start:l.sp]))
+}
+
 func (l *Lexer) group_ws() {
 	for {
 		l.adv()
@@ -241,32 +368,39 @@ func (l *Lexer) group_ws() {
 	}
 }
 
-func (l *Lexer) string() Token {
-	l.adv()
+// string literals and character constants, the quotes are kept in the
+// literal so that text lines can be written back out unchanged
+func (l *Lexer) quoted(q rune, ttype uint, what string) Token {
 	start := l.sp
+	l.adv()
 
 	for {
-		if l.isend() {
+		if l.isend() || l.peek() == '\n' {
 			break
-		} else if l.peek() == '"' {
+		} else if l.peek() == q {
 			break
+		} else if l.peek() == '\\' {
+			l.adv()
+			if !l.isend() && l.peek() != '\n' {
+				l.adv()
+			}
 		} else {
 			l.adv()
 		}
 	}
 
-	if l.isend() {
+	if l.isend() || l.peek() == '\n' {
 		return Token{
 			Type:    ERR,
-			Literal: "unterminated string",
+			Literal: "unterminated " + what,
 		}
 	}
 
-	end := l.sp
 	l.adv()
+	end := l.sp
 
 	return Token{
-		Type:    STRING,
+		Type:    ttype,
 		Literal: string(l.src[start:end]),
 	}
 }
@@ -286,6 +420,23 @@ func (l *Lexer) word() Token {
 
 	s := string(l.src[start:end])
 
+	// encoding prefixes of string literals and character constants
+	if !l.isend() && (l.peek() == '"' || l.peek() == '\'') {
+		switch s {
+		case "L", "u", "U", "u8":
+			var t Token
+			if l.peek() == '"' {
+				t = l.quoted('"', STRING, "string")
+			} else {
+				t = l.quoted('\'', CHAR_CONST, "character constant")
+			}
+			if t.Type != ERR {
+				t.Literal = s + t.Literal
+			}
+			return t
+		}
+	}
+
 	if kword, ok := l.keyword[s]; ok {
 		return tok(kword, s)
 	} else {
@@ -303,9 +454,7 @@ func (l *Lexer) oneOf(patterns ...string) (string, bool) {
 		i := 0
 
 		for i < len(p) {
-			if l.isend() {
-				return "", false
-			} else if rune(p[i]) != l.peek() {
+			if l.isend() || rune(p[i]) != l.peek() {
 				break
 			} else {
 				l.adv()
@@ -3,11 +3,28 @@ package cpp
 import "testing"
 
 func TestPpnum(t *testing.T) {
-	l := New("0 1 .1 0.1 0.1f 1 1 100ul .1ab.+-..-+")
+	l := New("0 1 .1 0.1 0.1f 1 1 100ul .1ae+..P-e-")
 	seq := []uint{PPNUM, WS, PPNUM, WS, PPNUM, WS, PPNUM,
 		WS, PPNUM, WS, PPNUM, WS, PPNUM, WS, PPNUM, WS, PPNUM, EOF}
 
 	tokseq(*l, seq, t)
+
+	// a sign only continues an exponent
+	l = New("1+1 0x1p-1-2")
+	seq = []uint{PPNUM, PUNCT, PPNUM, WS, PPNUM, PUNCT, PPNUM, EOF}
+
+	tokseq(*l, seq, t)
+
+	// digit separators are only read in C23
+	l = newLexer("1'000 1'a'", true)
+	seq = []uint{PPNUM, WS, PPNUM, ERR, EOF}
+
+	tokseq(*l, seq, t)
+
+	l = New("1'0'")
+	seq = []uint{PPNUM, CHAR_CONST, EOF}
+
+	tokseq(*l, seq, t)
 }
 
 func TestNewline(t *testing.T) {
@@ -25,9 +42,9 @@ func TestNonNewlineWS(t *testing.T) {
 }
 
 func TestKeywords(t *testing.T) {
-	l := New(`define elif else error if ifdef ifndef
+	l := New(`define elif else endif error if ifdef ifndef
 		include line pragma undef`)
-	seq := []uint{DEFINE, WS, ELIF, WS, ELSE, WS, ERROR, WS, IF, WS,
+	seq := []uint{DEFINE, WS, ELIF, WS, ELSE, WS, ENDIF, WS, ERROR, WS, IF, WS,
 		IFDEF, WS, IFNDEF, NEWLINE, WS, INCLUDE, WS, LINE, WS,
 		PRAGMA, WS, UNDEF}
 
@@ -62,15 +79,42 @@ func TestInsignificantPunctuators(t *testing.T) {
 }
 
 func TestSignificantPunctuators(t *testing.T) {
-	l := New(`, ... # )`)
+	l := New(`, ... # ) ## ###`)
 	seq := []uint{
 		COMMA, WS, ELLIP, WS, HASH, WS,
-		RPAREN,
+		RPAREN, WS, HASHHASH, WS, HASHHASH, HASH,
 	}
 
 	tokseq(*l, seq, t)
 }
 
+func TestQuoted(t *testing.T) {
+	tt := []struct {
+		input   string
+		ttype   uint
+		literal string
+	}{
+		{`"abc"`, STRING, `"abc"`},
+		{`"a\"b"`, STRING, `"a\"b"`},
+		{`'a'`, CHAR_CONST, `'a'`},
+		{`'\''`, CHAR_CONST, `'\''`},
+		{`L"a"`, STRING, `L"a"`},
+		{`u8"a"`, STRING, `u8"a"`},
+		{`U'a'`, CHAR_CONST, `U'a'`},
+		{"\"abc\n\"", ERR, "unterminated string"},
+		{"'a", ERR, "unterminated character constant"},
+	}
+
+	for _, test := range tt {
+		if tok := New(test.input).Lex(); tok.Type != test.ttype {
+			t.Errorf("expected %s, got %s for %s",
+				Tmap[test.ttype], Tmap[tok.Type], test.input)
+		} else if tok.Literal != test.literal {
+			t.Errorf(`want="%s", got="%s"`, test.literal, tok.Literal)
+		}
+	}
+}
+
 func tokseq(l Lexer, seq []uint, t *testing.T) {
 	for i, ttype := range seq {
 		tok := l.Lex()
@@ -80,3 +124,23 @@ func tokseq(l Lexer, seq []uint, t *testing.T) {
 		}
 	}
 }
+
+func TestHeaderName(t *testing.T) {
+	l := New("#include <stdio.h>\n # include <a b.h>\na <b.h>\n#define <b.h>")
+	seq := []uint{
+		HASH, INCLUDE, WS, HEADER, NEWLINE,
+		WS, HASH, WS, INCLUDE, WS, HEADER, NEWLINE,
+		IDENT, WS, PUNCT, IDENT, PUNCT, IDENT, PUNCT, NEWLINE,
+		HASH, DEFINE, WS, PUNCT, IDENT, PUNCT, IDENT, PUNCT, EOF,
+	}
+
+	tokseq(*l, seq, t)
+
+	l = New("#include <a b.h>")
+	l.Lex()
+	l.Lex()
+	l.Lex()
+	if tok := l.Lex(); tok.Literal != "<a b.h>" {
+		t.Errorf(`want="<a b.h>", got="%s"`, tok.Literal)
+	}
+}
@@ -0,0 +1,70 @@
+package cpp
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// '#' "line" digit-sequence s-char-sequence? '\n', where the operands are
+// macro expanded unless they already have this form; the line following
+// the directive is then reported as the given line of the given file
+func (p *Parser) lineDirective() {
+	rest := []Token{}
+	for !p.is(EOF) && !p.is(NEWLINE) {
+		rest = append(rest, p.curr)
+		p.adv()
+	}
+
+	// numbers and string literals are not changed by the expansion
+	toks := trimWS(p.expand(rest))
+	if len(toks) == 0 {
+		p.error("unexpected end of file after #line")
+		return
+	}
+
+	digits := toks[0].Literal
+	if toks[0].Type != PPNUM || strings.Trim(digits, "0123456789") != "" {
+		p.error("\"%s\" after #line is not a positive integer", digits)
+		return
+	}
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || n == 0 || n > math.MaxInt32 {
+		p.error("line number out of range")
+		return
+	}
+
+	name := p.presumed
+	if j := nextSignificant(toks, 1); j < len(toks) {
+		tok := toks[j]
+		if tok.Type != STRING || !strings.HasPrefix(tok.Literal, `"`) {
+			p.error("invalid filename \"%s\" after #line", tok.Literal)
+			return
+		}
+		if nextSignificant(toks, j+1) < len(toks) {
+			p.error("extra tokens at end of #line directive")
+			return
+		}
+		name = unquote(tok.Literal)
+	}
+
+	// the directive ends with the newline on its last physical line
+	p.presumed, p.delta = name, int(n)-(p.curr.Pos.Line+1)
+	p.resync = true
+}
+
+// the contents of a string literal, with only \\ and \" unescaped as in
+// the file names quote spells
+func unquote(s string) string {
+	var out bytes.Buffer
+
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		out.WriteByte(s[i])
+	}
+
+	return out.String()
+}
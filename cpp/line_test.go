@@ -0,0 +1,54 @@
+package cpp
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLineDirective(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.h": {Data: []byte("__FILE__ __LINE__\n")},
+	}
+	opts := Options{Filename: "main.c", FS: fsys}
+
+	tt := []Pair{
+		{"#line 10\n__LINE__\n__LINE__\n", "\n10\n11\n"},
+		{"#line 10 \"foo.c\"\n__FILE__ __LINE__\n", "\n\"foo.c\" 10\n"},
+		{"#line 5 \"a\\\\b.c\"\n__FILE__\n", "\n\"a\\\\b.c\"\n"},
+		{"#define L 20\n#define F \"bar.c\"\n#line L F\n__FILE__ __LINE__\n",
+			"\n\n\n\"bar.c\" 20\n"},
+		{"#define N(x) x\n#line N(7)\n__LINE__\n", "\n\n7\n"},
+		{"#line 0100\n__LINE__\n", "\n100\n"},
+		// only the name given by #line changes, not the file searched
+		{"#line 3 \"dir/x.c\"\n#include \"a.h\"\n__FILE__ __LINE__\n",
+			"\n\n\"a.h\" 1\n\"dir/x.c\" 4\n"},
+		{"#if 0\n#line 100\n#endif\n__LINE__\n", "\n\n\n4\n"},
+	}
+
+	for _, test := range tt {
+		check(t, NewParserOptions(New(test.input), opts), test.output)
+	}
+
+	errs := []string{
+		"#line\n",
+		"#line x\n",
+		"#line 0\n",
+		"#line 2147483648\n",
+		"#line 1e3\n",
+		"#line 0x10\n",
+		"#line 10 foo\n",
+		"#line 10 L\"foo\"\n",
+		"#line 10 \"foo\" x\n",
+	}
+	for _, src := range errs {
+		if _, err := NewParser(New(src)).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+
+	p := NewParserOptions(New("#line 41 \"foo.c\"\n#if\n#endif\n"), opts)
+	_, err := p.Expand()
+	if len(err) != 1 || err[0].Error() != "foo.c:41: #if with no expression" {
+		t.Errorf("diagnostics should use the line set by #line, got %v", err)
+	}
+}
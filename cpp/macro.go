@@ -3,19 +3,138 @@ package cpp
 import (
 	"bytes"
 	"fmt"
+	"io/fs"
+	"strings"
+	"time"
 )
 
 type Parser struct {
 	l      *Lexer
 	curr   Token
 	next   Token
-	macros map[string]string
+	macros map[string]*macro
 	err    []error
+	opts   Options
+	// the file being read, and the ones suspended by #include
+	name     string
+	files    []file
+	included *file
+	guard    guard
+	// include guard macros and #pragma once by resolved file name, files
+	// they apply to are not read again
+	guards  map[string]string
+	once    map[string]bool
+	skipped int
+	// tokens waiting to be rescanned, they are read before the lexer
+	queue    []Token
+	isolated bool
+	inIf     bool
+	conds    []cond
+	// the line of the directive or text line being processed
+	where int
+	// the file name and the line offset set by #line, used in diagnostics
+	// and by __FILE__ and __LINE__
+	presumed string
+	delta    int
+	// every file included, in the order they were first found
+	deps []dep
+	// an #error stops preprocessing
+	fatal bool
+	// a linemarker is due after #line
+	resync bool
+	// the current file was found in one of the system directories, and
+	// the position after the directory it was found in on the search
+	// path, 0 when it was not found through it
+	system bool
+	found  int
+	// pragma handlers by namespace, and the state of the builtin ones
+	pragmas map[string]PragmaHandler
+	pushed  map[string][]*macro
+	align   int
+	packs   []int
+	// state of __DATE__, __TIME__ and __COUNTER__
+	now     time.Time
+	counter int
+}
+
+type macro struct {
+	name     string
+	funclike bool
+	variadic bool
+	// for variadic macros the last parameter is __VA_ARGS__
+	params []string
+	body   []Token
+	// builtin macros whose replacement is computed at each use
+	dynamic func(p *Parser) Token
+	def     Location
+}
+
+// stands for an empty argument next to ## until pasting is done
+const placemarker = ^uint(0)
+
+type Options struct {
+	// name of the file being preprocessed, quoted includes are searched
+	// relative to it first
+	Filename string
+	// included files are read from FS
+	FS fs.FS
+	// directories searched by #include "..." before SystemDirs
+	QuoteDirs []string
+	// directories searched by both #include "..." and #include <...>
+	SystemDirs []string
+	// deepest nesting of #include allowed, 200 when zero
+	MaxIncludeDepth int
+	// the version of the standard __STDC_VERSION__ reports
+	Std Std
+	// the clock __DATE__ and __TIME__ are read from, time.Now when nil
+	Now func() time.Time
+	// command-line definitions, applied in order before the main file
+	Macros []MacroDef
+	// write GCC style linemarkers, like # 12 "foo.h" 1, when entering and
+	// leaving files, after #line and in place of long runs of empty lines
+	Linemarkers bool
+	// records every macro invocation when set
+	Tracer *Tracer
+}
+
+// a definition like -D or -U would give
+type MacroDef struct {
+	Undef bool
+	// NAME, NAME=value or NAME(params)=body, only NAME when undefining; a
+	// definition without a value defines NAME as 1
+	Text string
 }
 
 func NewParser(l *Lexer) *Parser {
-	p := &Parser{l: l}
+	return NewParserOptions(l, Options{})
+}
+
+func NewParserOptions(l *Lexer, opts Options) *Parser {
+	p := &Parser{
+		macros:  map[string]*macro{},
+		opts:    opts,
+		guards:  map[string]string{},
+		once:    map[string]bool{},
+		pragmas: map[string]PragmaHandler{},
+		pushed:  map[string][]*macro{},
+	}
 
+	if p.opts.MaxIncludeDepth == 0 {
+		p.opts.MaxIncludeDepth = 200
+	}
+	if p.opts.Now == nil {
+		p.opts.Now = time.Now
+	}
+	p.registerBuiltinPragmas()
+	p.predefine()
+	p.commandLine()
+
+	p.name, p.presumed = opts.Filename, opts.Filename
+	// the source is translated again once the language mode is known
+	if c23 := opts.Std == C23; c23 != l.c23 && l.sp == 0 {
+		*l = *newLexer(l.orig, c23)
+	}
+	p.l, p.curr, p.next = l, Token{}, Token{}
 	p.adv()
 	p.adv()
 
@@ -23,53 +142,796 @@ func NewParser(l *Lexer) *Parser {
 }
 
 func (p *Parser) Expand() (string, []error) {
-	var out bytes.Buffer
+	out := &output{markers: p.opts.Linemarkers}
+	p.run(out)
+
+	if len(p.err) != 0 {
+		return "", p.err
+	} else {
+		return out.String(), nil
+	}
+}
+
+// preprocesses the whole translation unit into out
+func (p *Parser) run(out *output) {
+	out.sync(1, p.presumed)
+
+	for !p.fatal {
+		if p.is(EOF) {
+			if !p.leave() {
+				break
+			}
+			out.sync(p.presumedLine(), p.presumed, p.markerFlags("2")...)
+			continue
+		}
+		p.where = p.presumedLine()
 
-	for !p.is(EOF) {
-		if !p.is(HASH) {
-			out.WriteString(p.preserveRest())
+		if !p.atDirective() {
+			if !p.blank() {
+				p.unguarded()
+			}
+			if !p.skipping() {
+				out.line(p.text(), p.where, p.presumed)
+				continue
+			}
+			// skipped lines are left empty to keep the line count
+			p.skipRest()
+			if p.is(NEWLINE) {
+				out.empty()
+			}
+			p.skipLine()
 			continue
 		}
+		p.skipWS()
 		p.adv()
+		p.skipWS()
 
 		switch p.curr.Type {
+		case IF, IFDEF, IFNDEF, ELIF, ELSE, ENDIF:
+			p.conditional()
+		default:
+			p.unguarded()
+			if p.skipping() {
+				break
+			}
+			if p.is(PRAGMA) {
+				if s, ok := p.pragmaDirective(); ok {
+					out.pragma(s, p.where, p.presumed)
+					p.skipLine()
+					continue
+				}
+				break
+			}
+			if s := p.directive(); s != "" {
+				out.text(s+"\n", p.where, p.presumed)
+				p.skipLine()
+				continue
+			}
+		}
+
+		p.skipLine()
+		out.empty()
+
+		if p.resync {
+			out.sync(p.presumedLine(), p.presumed)
+			p.resync = false
+		}
+
+		// the included file is only entered once the directive is over
+		if p.included != nil {
+			p.enter(p.included)
+			p.included = nil
+			out.sync(1, p.presumed, p.markerFlags("1")...)
+		}
+	}
+
+	if !p.fatal {
+		p.closeConds(0)
+	}
+}
+
+// control-line and non-directive, the '#' has been consumed
+func (p *Parser) directive() string {
+	switch p.curr.Type {
+	case NEWLINE, EOF:
+	case DEFINE:
+		p.adv()
+		p.define()
+	case UNDEF:
+		p.adv()
+		p.undef()
+		p.extraTokens("undef")
+	case INCLUDE, INCLUDE_NEXT:
+		directive := p.curr.Literal
+		p.adv()
+		p.include(directive)
+	case LINE:
+		p.adv()
+		p.lineDirective()
+	case ERROR:
+		p.adv()
+		p.skipWS()
+		p.error("#error %s", strings.TrimRight(p.preserveRest(), " "))
+		p.fatal = true
+	default:
+		return "#" + p.preserveRest()
+	}
+
+	return ""
+}
+
+// #pragma pp-tokens, the text following #pragma is returned when the
+// pragma is kept in the output
+func (p *Parser) pragmaDirective() (string, bool) {
+	p.adv()
+	p.skipWS()
+
+	toks := []Token{}
+	for !p.is(EOF) && !p.is(NEWLINE) {
+		toks = append(toks, p.curr)
+		p.adv()
+	}
+	if p.pragma(toks) {
+		return join(toks), true
+	}
+	return "", false
+}
+
+// text-line: every identifier naming a macro is replaced and rescanned,
+// the line is extended when the arguments of an invocation span lines
+func (p *Parser) text() []Token {
+	p.queue = p.line()
+
+	// a stray character is a preprocessing token, which only a text line
+	// may not be left with
+	out := p.expandQueue()
+	for _, tok := range out {
+		switch tok.Type {
+		case ERR:
+			p.error("%s", tok.Literal)
+		case OTHER:
+			p.error("stray '%s' in program", tok.Literal)
+		}
+	}
+
+	return out
+}
+
+// fully expands toks without reading anything past them, as is done to
+// arguments before substitution
+func (p *Parser) expand(toks []Token) []Token {
+	queue, isolated := p.queue, p.isolated
+	p.queue, p.isolated = append([]Token{}, toks...), true
+	if p.opts.Tracer != nil {
+		p.opts.Tracer.depth++
+		defer func() { p.opts.Tracer.depth-- }()
+	}
+
+	out := p.expandQueue()
+
+	p.queue, p.isolated = queue, isolated
+	return out
+}
+
+// the expansion algorithm of Prosser: every token remembers the macros it
+// was produced by in its hide set, and a macro is never replaced by a
+// token carrying its own name in its hide set. For function-like macros
+// only the names both the macro name and the closing parenthesis of the
+// invocation were hidden from are inherited.
+func (p *Parser) expandQueue() []Token {
+	out := []Token{}
+
+	for len(p.queue) > 0 {
+		tok := p.pop()
+
+		if p.inIf && isIdent(tok) && tok.Literal == "defined" {
+			out = p.emit(out, tok)
+			out = p.emit(out, p.definedOperand()...)
+			continue
+		}
+
+		if p.inIf && isIdent(tok) &&
+			(tok.Literal == "__has_include" || tok.Literal == "__has_include_next") {
+			out = p.emit(out, p.hasInclude(tok.Literal))
+			continue
+		}
+
+		if !p.inIf && isIdent(tok) && tok.Literal == "_Pragma" &&
+			!tok.Hide.Has("_Pragma") {
+			out = p.emit(out, p.pragmaOperator(tok)...)
+			continue
+		}
+
+		m, ok := p.macros[tok.Literal]
+		if !isIdent(tok) || !ok || tok.Hide.Has(m.name) {
+			out = p.emit(out, tok)
+			continue
+		}
+
+		if m.dynamic != nil {
+			e := p.invoke(m, tok, nil)
+			p.push(p.replaced(e, []Token{m.dynamic(p)}), 0)
+			continue
+		}
+		if !m.funclike {
+			e := p.invoke(m, tok, nil)
+			hs := tok.Hide.add(m.name)
+			p.push(p.replaced(e, p.substitute(m, nil, hs)), 0)
+			continue
+		}
+
+		lines := p.openParen()
+		if lines < 0 {
+			out = p.emit(out, tok)
+			continue
+		}
+		if args, rparen, ok := p.arguments(m, &lines); ok {
+			e := p.invoke(m, tok, args)
+			hs := tok.Hide.intersect(rparen.Hide).add(m.name)
+			p.push(p.replaced(e, p.substitute(m, args, hs)), lines)
+		}
+	}
+
+	return out
+}
+
+// takes the operand of defined from the queue, as far as it is well formed
+func (p *Parser) definedOperand() []Token {
+	q := p.queue
+	n := 0
+
+	i := nextSignificant(q, 0)
+	if i < len(q) && q[i].Type == PUNCT && q[i].Literal == "(" {
+		n = i + 1
+		if i = nextSignificant(q, n); i < len(q) && isIdent(q[i]) {
+			n = i + 1
+			if i = nextSignificant(q, n); i < len(q) && q[i].Type == RPAREN {
+				n = i + 1
+			}
+		}
+	} else if i < len(q) && isIdent(q[i]) {
+		n = i + 1
+	}
+
+	p.queue = q[n:]
+	return q[:n]
+}
+
+// pushes a replacement list in front of the queue to be rescanned,
+// newlines swallowed by the invocation are put back after it so that the
+// output keeps its line count
+func (p *Parser) push(body []Token, lines int) {
+	toks := make([]Token, 0, len(body)+lines+len(p.queue))
+
+	toks = append(toks, body...)
+	for i := 0; i < lines; i++ {
+		toks = append(toks, Token{Type: NEWLINE, Literal: "\n"})
+	}
+	toks = append(toks, p.queue...)
+
+	p.queue = toks
+}
+
+// looks for the '(' beginning an invocation, on success it is consumed
+// along with everything before it and the number of newlines skipped is
+// returned, -1 otherwise
+func (p *Parser) openParen() int {
+	for i := 0; ; i++ {
+		if i >= len(p.queue) && !p.fill() {
+			return -1
+		}
+
+		switch tok := p.queue[i]; tok.Type {
+		case WS, NEWLINE:
+			continue
+		case PUNCT:
+			if tok.Literal != "(" {
+				return -1
+			}
+		default:
+			return -1
+		}
+
+		lines := 0
+		for _, tok := range p.queue[:i] {
+			if tok.Type == NEWLINE {
+				lines++
+			}
+		}
+		p.queue = p.queue[i+1:]
+
+		return lines
+	}
+}
+
+// collects the arguments up to the matching ')', which is returned as
+// well, newlines inside of them count as whitespace
+func (p *Parser) arguments(m *macro, lines *int) ([][]Token, Token, bool) {
+	args := [][]Token{}
+	arg := []Token{}
+	depth := 0
+
+	for {
+		if len(p.queue) == 0 && !p.fill() {
+			p.error("unterminated argument list invoking macro %s", m.name)
+			return nil, Token{}, false
+		}
+		tok := p.pop()
+
+		switch tok.Type {
 		case NEWLINE:
-			p.adv()
-			out.WriteString("\n")
-		case DEFINE:
-			p.adv()
-			p.define()
+			*lines++
+			tok = Token{Type: WS, Literal: " "}
+		case PUNCT:
+			if tok.Literal == "(" {
+				depth++
+			}
+		case RPAREN:
+			if depth == 0 {
+				args = append(args, trimWS(arg))
+				args, ok := p.bind(m, args)
+				return args, tok, ok
+			}
+			depth--
+		case COMMA:
+			// commas belong to __VA_ARGS__ once the named parameters
+			// have been matched
+			variadic := m.variadic && len(args) == len(m.params)-1
+			if depth == 0 && !variadic {
+				args = append(args, trimWS(arg))
+				arg = []Token{}
+				continue
+			}
+		}
+
+		arg = append(arg, tok)
+	}
+}
+
+// checks the number of arguments against the parameters of m
+func (p *Parser) bind(m *macro, args [][]Token) ([][]Token, bool) {
+	// f() passes one empty argument, which is no argument at all when f
+	// takes no parameters
+	if len(m.params) == 0 && len(args) == 1 && len(args[0]) == 0 {
+		return [][]Token{}, true
+	}
+	// the variable arguments may be left out entirely
+	if m.variadic && len(args) == len(m.params)-1 {
+		args = append(args, []Token{})
+	}
+
+	if len(args) < len(m.params) {
+		p.error("macro %s requires %d arguments, but only %d given",
+			m.name, len(m.params), len(args))
+		return nil, false
+	} else if len(args) > len(m.params) {
+		p.error("macro %s passed %d arguments, but takes just %d",
+			m.name, len(args), len(m.params))
+		return nil, false
+	}
+
+	return args, true
+}
+
+// replaces every parameter in the body by its fully expanded argument,
+// or by the argument as written when it is an operand of # or ##, hs is
+// added to the hide set of every resulting token
+func (p *Parser) substitute(m *macro, args [][]Token, hs Hideset) []Token {
+	out := []Token{}
+	body := m.body
+	// each argument is expanded once, however often it is used
+	expanded := make([][]Token, len(args))
+
+	for i := 0; i < len(body); i++ {
+		tok := body[i]
+
+		switch {
+		case tok.Type == HASH && m.funclike:
+			j := nextSignificant(body, i+1)
+			out = append(out, stringify(args[m.param(body[j])]))
+			i = j
+		case tok.Type == HASHHASH:
+			for len(out) > 0 && out[len(out)-1].Type == WS {
+				out = out[:len(out)-1]
+			}
+
+			j := nextSignificant(body, i+1)
+			var rhs []Token
+			if body[j].Type == HASH && m.funclike {
+				j = nextSignificant(body, j+1)
+				rhs = []Token{stringify(args[m.param(body[j])])}
+			} else if k := m.param(body[j]); k >= 0 {
+				rhs = args[k]
+			} else {
+				rhs = []Token{body[j]}
+			}
+			out = p.paste(out, rhs)
+			i = j
+		case m.param(tok) >= 0:
+			arg := args[m.param(tok)]
+			if j := nextSignificant(body, i+1); j < len(body) &&
+				body[j].Type == HASHHASH {
+				// an empty operand of ## is a placemarker
+				if len(arg) == 0 {
+					arg = []Token{{Type: placemarker}}
+				}
+				out = append(out, arg...)
+			} else {
+				k := m.param(tok)
+				if expanded[k] == nil {
+					expanded[k] = p.expand(arg)
+				}
+				out = append(out, expanded[k]...)
+			}
 		default:
-			out.WriteString(p.preserveRest())
+			out = append(out, tok)
 		}
 	}
 
-	if len(p.err) != 0 {
-		return "", p.err
-	} else {
-		return out.String(), nil
+	result := []Token{}
+	for _, tok := range out {
+		if tok.Type != placemarker {
+			tok.Hide = tok.Hide.union(hs)
+			result = append(result, tok)
+		}
+	}
+	return result
+}
+
+// # operator: the spelling of the argument becomes a string literal, with
+// each whitespace sequence turned into one space
+func stringify(arg []Token) Token {
+	var out bytes.Buffer
+
+	out.WriteByte('"')
+	for i, tok := range arg {
+		switch tok.Type {
+		case WS:
+			if i > 0 && arg[i-1].Type != WS {
+				out.WriteByte(' ')
+			}
+		case STRING, CHAR_CONST:
+			for _, c := range tok.Literal {
+				if c == '"' || c == '\\' {
+					out.WriteByte('\\')
+				}
+				out.WriteRune(c)
+			}
+		default:
+			out.WriteString(tok.Literal)
+		}
+	}
+	out.WriteByte('"')
+
+	return Token{Type: STRING, Literal: out.String()}
+}
+
+// ## operator: the last token of lhs and the first of rhs are joined into
+// a single token, which is lexed again
+func (p *Parser) paste(lhs []Token, rhs []Token) []Token {
+	if len(rhs) == 0 {
+		return lhs
+	}
+	last := lhs[len(lhs)-1]
+	lhs = lhs[:len(lhs)-1]
+
+	switch {
+	case last.Type == placemarker:
+		return append(lhs, rhs...)
+	case rhs[0].Type == placemarker:
+		return append(append(lhs, last), rhs[1:]...)
+	}
+
+	s := last.Literal + rhs[0].Literal
+	l := p.lexer(s)
+	tok := l.Lex()
+
+	if tok.Type == ERR || tok.Type == WS || l.Lex().Type != EOF {
+		p.error("pasting \"%s\" and \"%s\" does not give a valid preprocessing token",
+			last.Literal, rhs[0].Literal)
+		return append(append(lhs, last), rhs...)
+	}
+
+	return append(append(lhs, tok), rhs[1:]...)
+}
+
+// index of the first non whitespace token from i on, len(toks) if none
+func nextSignificant(toks []Token, i int) int {
+	for i < len(toks) && toks[i].Type == WS {
+		i++
+	}
+	return i
+}
+
+func (m *macro) param(tok Token) int {
+	if !isIdent(tok) {
+		return -1
+	}
+	for i, name := range m.params {
+		if name == tok.Literal {
+			return i
+		}
+	}
+	return -1
+}
+
+// reads a physical line, including its newline
+func (p *Parser) line() []Token {
+	line := []Token{}
+
+	for !p.is(EOF) && !p.is(NEWLINE) {
+		line = append(line, p.curr)
+		p.adv()
+	}
+	if p.is(NEWLINE) {
+		line = append(line, p.curr)
+		p.adv()
 	}
+
+	return line
+}
+
+// the presumed line of the current token, read from the lexer at the
+// beginning of a line; splices and comments spanning lines are counted
+// since the position is the one in the original source
+func (p *Parser) presumedLine() int {
+	return p.curr.Pos.Line + p.delta
+}
+
+// appends the next line to the queue unless it is a directive
+func (p *Parser) fill() bool {
+	if p.isolated || p.is(EOF) || p.atDirective() {
+		return false
+	}
+	p.queue = append(p.queue, p.line()...)
+	return true
+}
+func (p *Parser) pop() Token {
+	tok := p.queue[0]
+	p.queue = p.queue[1:]
+	return tok
+}
+
+// the line holds nothing but whitespace
+func (p *Parser) blank() bool {
+	return p.is(NEWLINE) || p.is(EOF) ||
+		(p.is(WS) && (p.next.Type == NEWLINE || p.next.Type == EOF))
+}
+
+// whitespace may precede the '#' of a directive
+func (p *Parser) atDirective() bool {
+	return p.is(HASH) || (p.is(WS) && p.next.Type == HASH)
 }
 
 func (p *Parser) define() {
-	switch p.curr.Type {
-	case IDENT:
-		p.defineSimpleMacro(p.curr.Literal)
+	p.skipWS()
+
+	if !isIdent(p.curr) {
+		p.error("macro name must be an identifier, got %s", toks(p.curr.Type))
+		return
+	}
+	name := p.curr.Literal
+	if name == "defined" {
+		p.error("\"defined\" cannot be used as a macro name")
+		return
+	}
+	def := Location{p.presumed, p.curr.Pos.Line + p.delta, p.curr.Pos.Col}
+	p.adv()
+
+	// only a '(' immediately following the name begins a parameter list
+	if p.is(PUNCT) && p.curr.Literal == "(" {
+		p.adv()
+		p.defineFunctionMacro(name, def)
+	} else {
+		p.defineSimpleMacro(name, def)
 	}
 }
-func (p *Parser) defineSimpleMacro(name string) string {
-	return ""
+
+// removes the macro named by the current token
+func (p *Parser) undef() {
+	p.skipWS()
+
+	if !isIdent(p.curr) {
+		p.error("macro name must be an identifier, got %s", toks(p.curr.Type))
+		return
+	} else if p.curr.Literal == "defined" {
+		p.error("\"defined\" cannot be used as a macro name")
+		return
+	}
+
+	delete(p.macros, p.curr.Literal)
+	p.adv()
+}
+func (p *Parser) defineSimpleMacro(name string, def Location) {
+	p.skipWS()
+
+	m := &macro{name: name, body: p.replacement(), def: def}
+	if p.checkVarArgs(m) && p.checkOperators(m) {
+		p.addMacro(m)
+	}
+}
+func (p *Parser) defineFunctionMacro(name string, def Location) {
+	m := &macro{name: name, funclike: true, params: []string{}, def: def}
+
+	if !p.parameters(m) {
+		return
+	}
+	p.skipWS()
+	m.body = p.replacement()
+
+	if p.checkVarArgs(m) && p.checkOperators(m) {
+		p.addMacro(m)
+	}
+}
+
+// __VA_ARGS__ only appears in the replacement list of variadic macros,
+// object-like ones included
+func (p *Parser) checkVarArgs(m *macro) bool {
+	for _, tok := range m.body {
+		if isIdent(tok) && tok.Literal == "__VA_ARGS__" && !m.variadic {
+			p.error("__VA_ARGS__ can only appear in the expansion of a variadic macro")
+			return false
+		}
+	}
+	return true
+}
+
+// ## needs an operand on both sides, and in a function-like macro # must
+// be followed by a parameter
+func (p *Parser) checkOperators(m *macro) bool {
+	body := m.body
+
+	if len(body) > 0 && (body[0].Type == HASHHASH ||
+		body[len(body)-1].Type == HASHHASH) {
+		p.error("'##' cannot appear at either end of a macro expansion")
+		return false
+	}
+
+	if !m.funclike {
+		return true
+	}
+	for i, tok := range body {
+		if tok.Type != HASH {
+			continue
+		}
+		if j := nextSignificant(body, i+1); j >= len(body) || m.param(body[j]) < 0 {
+			p.error("'#' is not followed by a macro parameter")
+			return false
+		}
+	}
+
+	return true
 }
+
+// identifier-list? RPAREN, where the list may end with "..."
+func (p *Parser) parameters(m *macro) bool {
+	p.skipWS()
+	if p.is(RPAREN) {
+		p.adv()
+		return true
+	}
+
+	for {
+		p.skipWS()
+
+		if p.is(ELLIP) {
+			m.variadic = true
+			m.params = append(m.params, "__VA_ARGS__")
+			p.adv()
+			p.skipWS()
+			break
+		}
+
+		if !isIdent(p.curr) {
+			p.error("expected parameter name, got %s", toks(p.curr.Type))
+			return false
+		}
+		name := p.curr.Literal
+		if name == "__VA_ARGS__" {
+			p.error("__VA_ARGS__ can not be used as a parameter name")
+			return false
+		}
+		for _, param := range m.params {
+			if param == name {
+				p.error("duplicate macro parameter %s", name)
+				return false
+			}
+		}
+		m.params = append(m.params, name)
+		p.adv()
+		p.skipWS()
+
+		if !p.is(COMMA) {
+			break
+		}
+		p.adv()
+	}
+
+	if !p.expect(RPAREN) {
+		return false
+	}
+	p.adv()
+
+	return true
+}
+func (p *Parser) addMacro(m *macro) {
+	if old, ok := p.macros[m.name]; ok && !sameMacro(old, m) {
+		p.error("macro %s redefined", m.name)
+		return
+	}
+
+	p.macros[m.name] = m
+}
+
+// replacement list: the rest of the directive with trailing ws removed
+func (p *Parser) replacement() []Token {
+	body := []Token{}
+
+	for !p.is(EOF) && !p.is(NEWLINE) {
+		body = append(body, p.curr)
+		p.adv()
+	}
+
+	return trimWS(body)
+}
+func sameMacro(a, b *macro) bool {
+	if a.funclike != b.funclike || a.variadic != b.variadic ||
+		len(a.params) != len(b.params) || len(a.body) != len(b.body) {
+		return false
+	}
+	for i := range a.params {
+		if a.params[i] != b.params[i] {
+			return false
+		}
+	}
+	for i := range a.body {
+		if a.body[i].Type != b.body[i].Type ||
+			a.body[i].Literal != b.body[i].Literal {
+			return false
+		}
+	}
+	return true
+}
+
+// the rest of the line as written; the literal of a malformed token is a
+// diagnostic, so its text is taken from the original source up to the
+// token following it
 func (p *Parser) preserveRest() string {
 	var out bytes.Buffer
 
 	for !p.is(EOF) && !p.is(NEWLINE) {
-		out.WriteString(p.curr.Literal)
+		if p.is(ERR) {
+			out.WriteString(p.l.orig[p.curr.Pos.Offset:p.next.Pos.Offset])
+		} else {
+			out.WriteString(p.curr.Literal)
+		}
 		p.adv()
 	}
 
 	return out.String()
 }
+func (p *Parser) skipWS() {
+	for p.is(WS) {
+		p.adv()
+	}
+}
+
+// skips to the end of the current line
+func (p *Parser) skipRest() {
+	for !p.is(EOF) && !p.is(NEWLINE) {
+		p.adv()
+	}
+}
+
+// skips to the beginning of the next line
+func (p *Parser) skipLine() {
+	for !p.is(EOF) && !p.is(NEWLINE) {
+		p.adv()
+	}
+	if p.is(NEWLINE) {
+		p.adv()
+	}
+}
 func (p *Parser) peek() uint {
 	return p.curr.Type
 }
@@ -89,9 +951,51 @@ func (p *Parser) expect(ttype uint) bool {
 		return true
 	}
 }
+
+// directive names are lexed as keywords but are ordinary identifiers
+// everywhere else
+func isIdent(tok Token) bool {
+	return tok.Type == IDENT || (tok.Type >= DEFINE && tok.Type <= UNDEF)
+}
+
+// lexes src into tokens, as needed for replacement lists that do not come
+// from a #define
+func tokenize(src string) []Token {
+	l := New(src)
+	toks := []Token{}
+
+	for tok := l.Lex(); tok.Type != EOF; tok = l.Lex() {
+		toks = append(toks, tok)
+	}
+
+	return toks
+}
+func trimWS(toks []Token) []Token {
+	for len(toks) > 0 && toks[0].Type == WS {
+		toks = toks[1:]
+	}
+	for len(toks) > 0 && toks[len(toks)-1].Type == WS {
+		toks = toks[:len(toks)-1]
+	}
+	return toks
+}
+func join(toks []Token) string {
+	var out bytes.Buffer
+
+	for _, tok := range toks {
+		out.WriteString(tok.Literal)
+	}
+
+	return out.String()
+}
 func toks(ttype uint) string {
 	return Tmap[ttype]
 }
 func (p *Parser) error(format string, rest ...any) {
-	p.err = append(p.err, fmt.Errorf(format, rest...))
+	msg := fmt.Sprintf(format, rest...)
+	if p.presumed != "" {
+		p.err = append(p.err, fmt.Errorf("%s:%d: %s", p.presumed, p.where, msg))
+	} else {
+		p.err = append(p.err, fmt.Errorf("line %d: %s", p.where, msg))
+	}
 }
@@ -1,6 +1,9 @@
 package cpp
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestNonDirectiveTokens(t *testing.T) {
 	src := "int main(void) { return 0; }"
@@ -9,6 +12,17 @@ func TestNonDirectiveTokens(t *testing.T) {
 	check(t, p, src)
 }
 
+type Pair struct {
+	input  string
+	output string
+}
+
+func checkAll(t *testing.T, tt []Pair) {
+	for _, test := range tt {
+		check(t, NewParser(New(test.input)), test.output)
+	}
+}
+
 func check(t *testing.T, p *Parser, expected string) {
 	if expanded, err := p.Expand(); len(err) != 0 {
 		for _, e := range err {
@@ -19,3 +33,329 @@ func check(t *testing.T, p *Parser, expected string) {
 			expanded, expected)
 	}
 }
+
+func TestObjectLikeMacro(t *testing.T) {
+	tt := []Pair{
+		{"#define A 1\nA", "\n1"},
+		{"#define A 1 + 2\nx = A;\n", "\nx = 1 + 2;\n"},
+		{"  #  define A   1  \nA", "\n1"},
+		{"#define A\nA;", "\n;"},
+		{"#define A B\n#define B 2\nA", "\n\n2"},
+		{"#define A \"a\"\nA", "\n\"a\""},
+		{"#define A 1\n#define A 1\nA", "\n\n1"},
+		{"#define define 1\ndefine", "\n1"},
+		{"#\nA", "\nA"},
+		{"a\nb\n", "a\nb\n"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestSelfReferentialObjectLikeMacro(t *testing.T) {
+	tt := []Pair{
+		{"#define foo foo\nfoo", "\nfoo"},
+		{"#define foo a foo b\nfoo", "\na foo b"},
+		{"#define a b\n#define b a\na b", "\n\na b"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestMacroRedefinition(t *testing.T) {
+	p := NewParser(New("#define A 1\n#define A 2\n"))
+	if _, err := p.Expand(); len(err) == 0 {
+		t.Errorf("incompatible redefinition not reported")
+	}
+
+	p = NewParser(New("#define 1 2\n"))
+	if _, err := p.Expand(); len(err) == 0 {
+		t.Errorf("non identifier macro name not reported")
+	}
+}
+
+func TestUndef(t *testing.T) {
+	tt := []Pair{
+		{"#define A 1\n#undef A\nA", "\n\nA"},
+		{"#define A 1\nA\n#undef A\nA\n#define A 2\nA", "\n1\n\nA\n\n2"},
+		{"#define f(x) x\n#undef f\nf(1)", "\n\nf(1)"},
+		{"#undef A\nA", "\nA"},
+		{"#undef __LINE__\n__LINE__", "\n__LINE__"},
+		// a macro is looked up when its invocation is read
+		{"#define A B\n#define B 1\nA\n#undef B\nA", "\n\n1\n\nB"},
+	}
+
+	checkAll(t, tt)
+
+	errs := []string{
+		"#undef\n",
+		"#undef 1\n",
+		"#undef A B\n",
+		"#undef defined\n",
+	}
+	for _, src := range errs {
+		if _, err := NewParser(New(src)).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+}
+
+func TestNullDirective(t *testing.T) {
+	checkAll(t, []Pair{
+		{"#\na\n", "\na\n"},
+		{"  #  \na\n#", "\na\n\n"},
+		{"#if 0\n#\n#endif\n", "\n\n\n"},
+	})
+}
+
+func TestError(t *testing.T) {
+	p := NewParserOptions(New("a\n#error  \"broken\" build \nb\n#error other\n"),
+		Options{Filename: "main.c"})
+	_, err := p.Expand()
+	if len(err) != 1 || err[0].Error() != `main.c:2: #error "broken" build` {
+		t.Errorf("expected a single #error diagnostic, got %v", err)
+	}
+
+	// the conditionals left open are not reported after a fatal error
+	p = NewParser(New("#if 1\n#error stop\n"))
+	if _, err := p.Expand(); len(err) != 1 {
+		t.Errorf("expected only the #error diagnostic, got %v", err)
+	}
+
+	checkAll(t, []Pair{{"#if 0\n#error skipped\n#endif\n", "\n\n\n"}})
+
+	// malformed tokens are reported as written
+	_, err = NewParser(New("#error don't do this\n")).Expand()
+	if len(err) != 1 || err[0].Error() != "line 1: #error don't do this" {
+		t.Errorf("expected the text as written, got %v", err)
+	}
+	checkAll(t, []Pair{{"#foo don't\nx\n", "#foo don't\nx\n"}})
+}
+
+func TestFunctionLikeMacro(t *testing.T) {
+	tt := []Pair{
+		{"#define f() 1\nf()", "\n1"},
+		{"#define f(a) a\nf(1)", "\n1"},
+		{"#define f(a, b) a + b\nf( 1 , 2 )", "\n1 + 2"},
+		{"#define f(a, b) a + b\nf((1, 2), ((3)))", "\n(1, 2) + ((3))"},
+		{"#define f(a) a\nf", "\nf"},
+		{"#define f(a) a\nf + 1", "\nf + 1"},
+		{"#define f(a) [a]\nf()", "\n[]"},
+		{"#define f (a) a\nf", "\n(a) a"},
+		{"#define f(a) a\nf\n(1)\nx", "\n1\n\nx"},
+		{"#define f(a, b) a b\nf(1,\n2)\nx", "\n1 2\n\nx"},
+		{"#define f(a) a\nf\n#define g 1\ng", "\nf\n\n1"},
+		{"#define f(a) a\n#define g f\ng(1)", "\n\n1"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestVariadicMacro(t *testing.T) {
+	tt := []Pair{
+		{"#define f(...) __VA_ARGS__\nf(1, 2, 3)", "\n1, 2, 3"},
+		{"#define f(...) [__VA_ARGS__]\nf()", "\n[]"},
+		{"#define f(a, ...) a: __VA_ARGS__\nf(1, 2, (3, 4))", "\n1: 2, (3, 4)"},
+		{"#define f(a, ...) a: __VA_ARGS__\nf(1)", "\n1: "},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestArgumentPreExpansion(t *testing.T) {
+	tt := []Pair{
+		{"#define A 1\n#define f(a) a\nf(A)", "\n\n1"},
+		{"#define f(a) a\nf(f(1))", "\n1"},
+		{"#define f(a) (a)\n#define g(a) f(a) f(a)\ng(f(1))", "\n\n((1)) ((1))"},
+		{"#define A B\n#define B 2\n#define f(a) a\nf(A)", "\n\n\n2"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestFunctionLikeMacroErrors(t *testing.T) {
+	tt := []string{
+		"#define f(a) a\nf(1, 2)",
+		"#define f(a, b) a\nf(1)",
+		"#define f() 1\nf(1)",
+		"#define f(a) a\nf(1",
+		"#define f(a, a) a\n",
+		"#define f(a,) a\n",
+		"#define f(a) __VA_ARGS__\n",
+		"#define A __VA_ARGS__\nA\n",
+		"#define A(...) __VA_ARGS__\n#define B A(__VA_ARGS__)\n",
+		"#define f(__VA_ARGS__) 1\n",
+		"#define f(a) a\n#define f(b) b\n",
+	}
+
+	for _, src := range tt {
+		if _, err := NewParser(New(src)).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+}
+
+func TestStringification(t *testing.T) {
+	tt := []Pair{
+		{"#define s(a) #a\ns(abc)", "\n\"abc\""},
+		{"#define s(a) #a\ns()", "\n\"\""},
+		{"#define s(a) # a\ns(  a  +   b  )", "\n\"a + b\""},
+		{"#define s(a) #a\ns(\"a\\n\" '\"')", "\n\"\\\"a\\\\n\\\" '\\\"'\""},
+		{"#define s(a) #a\n#define A 1\ns(A)", "\n\n\"A\""},
+		{"#define s(...) #__VA_ARGS__\ns(a, b)", "\n\"a, b\""},
+		{"#define s(a) #a\ns(a\nb)", "\n\"a b\"\n"},
+		{"#define A #x\nA", "\n#x"},
+		// stray characters are preprocessing tokens of their own
+		{"#define s(a) #a\ns(@) s($x) s(`)", "\n\"@\" \"$x\" \"`\""},
+	}
+
+	checkAll(t, tt)
+
+	// unless they are left in a text line
+	for _, src := range []string{"@\n", "#define s(a) a\ns(@)\n"} {
+		if _, err := NewParser(New(src)).Expand(); len(err) != 1 ||
+			!strings.Contains(err[0].Error(), "stray '@'") {
+			t.Errorf("expected a stray '@' in %q, got %v", src, err)
+		}
+	}
+	if _, err := NewParser(New("#if 0\n@\n#endif\n#define A @\n")).Expand(); len(err) != 0 {
+		t.Errorf("unexpected errors %v", err)
+	}
+}
+
+func TestTokenPasting(t *testing.T) {
+	tt := []Pair{
+		{"#define cat(a, b) a ## b\ncat(x, y)", "\nxy"},
+		{"#define cat(a, b) a##b\ncat(1, 2)", "\n12"},
+		{"#define cat(a, b) a ## b\ncat(+, =)", "\n+="},
+		{"#define cat(a, b) a ## b\ncat(, y)", "\ny"},
+		{"#define cat(a, b) a ## b\ncat(x, )", "\nx"},
+		{"#define cat(a, b) a ## b\ncat(,)", "\n"},
+		{"#define cat(a, b, c) a ## b ## c\ncat(x, y, z)", "\nxyz"},
+		{"#define cat(a, b) a ## b\n#define x 1\ncat(x, )", "\n\n1"},
+		{"#define cat(a, b) a ## b\n#define xy 1\ncat(x, y)", "\n\n1"},
+		{"#define cat(a, b) a ## b\ncat(x y, z w)", "\nx yz w"},
+		{"#define A x ## y\nA", "\nxy"},
+		{"#define f(a) L ## #a\nf(s)", "\nL\"s\""},
+		{"#define f(a) a ## 1\nf(0x)", "\n0x1"},
+		{"#define hash_hash # ## #\nhash_hash", "\n##"},
+	}
+
+	checkAll(t, tt)
+}
+
+func TestOperatorErrors(t *testing.T) {
+	tt := []string{
+		"#define f(a) #b\n",
+		"#define f(a) #\n",
+		"#define f(a) ## a\n",
+		"#define f(a) a ##\n",
+		"#define A ## a\n",
+		"#define cat(a, b) a ## b\ncat(+, /)",
+		"#define cat(a, b) a ## b\ncat(., a)",
+	}
+
+	for _, src := range tt {
+		if _, err := NewParser(New(src)).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+}
+
+func TestRecursiveMacros(t *testing.T) {
+	tt := []Pair{
+		{"#define foo foo + 1\nfoo", "\nfoo + 1"},
+		{"#define foo(a) foo(a + 1)\nfoo(foo(0))", "\nfoo(foo(0 + 1) + 1)"},
+		{"#define a b + 1\n#define b a + 2\na b", "\n\na + 2 + 1 b + 1 + 2"},
+		{"#define f(a) a*g\n#define g(a) f(a)\nf(2)(9)", "\n\n2*9*g"},
+		{"#define f(a) a\n#define g f(g)\ng", "\n\ng"},
+		{"#define f(a) f\nf(1)(2)(3)", "\nf(2)(3)"},
+		{"#define obj f\n#define f(a) obj a\nf(1)(2)", "\n\nf 1(2)"},
+	}
+
+	checkAll(t, tt)
+}
+
+// EXAMPLE 3 to 5 and 7 of C11 6.10.3.5, the #include of the second is kept
+// as an ordinary line, and the newline inside of the first str invocation
+// is put back after it
+func TestStandardExamples(t *testing.T) {
+	tt := []Pair{
+		{`#define x 3
+#define f(a) f(x * (a))
+#undef x
+#define x 2
+#define g f
+#define z z[0]
+#define h g(~
+#define m(a) a(w)
+#define w 0,1
+#define t(a) a
+#define p() int
+#define q(x) x
+#define r(x,y) x ## y
+#define str(x) # x
+f(y+1) + f(f(z)) % t(t(g)(0) + t)(1);
+g(x+(3,4)-w) | h 5) & m
+(f)^m(m);
+p() i[q()] = { q(1), r(2,3), r(4,), r(,5), r(,) };
+char c[2][6] = { str(hello), str() };
+`, `f(2 * (y+1)) + f(2 * (f(2 * (z[0])))) % f(2 * (0)) + t(1);
+f(2 * (2+(3,4)-0,1)) | f(2 * (~ 5)) & f(2 * (0,1))
+^m(0,1);
+int i[] = { 1, 23, 4, 5,  };
+char c[2][6] = { "hello", "" };
+`},
+		{`#define str(s) # s
+#define xstr(s) str(s)
+#define debug(s, t) printf("x" # s "= %d, x" # t "= %s", \
+ x ## s, x ## t)
+#define INCFILE(n) vers ## n
+#define glue(a, b) a ## b
+#define xglue(a, b) glue(a, b)
+#define HIGHLOW "hello"
+#define LOW LOW ", world"
+debug(1, 2);
+fputs(str(strncmp("abc\0d", "abc", '\4') // this goes away
+ == 0) str(: @\n), s);
+xstr(INCFILE(2).h)
+glue(HIGH, LOW);
+xglue(HIGH, LOW)
+`, `printf("x" "1" "= %d, x" "2" "= %s", x1, x2);
+fputs("strncmp(\"abc\\0d\", \"abc\", '\\4') == 0"
+ ": @\n", s);
+"vers2.h"
+"hello";
+"hello" ", world"
+`},
+		{`#define t(x,y,z) x ## y ## z
+int j[] = { t(1,2,3), t(,4,5), t(6,,7), t(8,9,),
+ t(10,,), t(,11,), t(,,12), t(,,) };
+`, `int j[] = { 123, 45, 67, 89,
+ 10, 11, 12,  };
+`},
+		{`#define debug(...) fprintf(stderr, __VA_ARGS__)
+#define showlist(...) puts(#__VA_ARGS__)
+#define report(test, ...) ((test)?puts(#test):\
+ printf(__VA_ARGS__))
+debug("Flag");
+debug("X = %d\n", x);
+showlist(The first, second, and third items.);
+report(x>y, "x is %d but y is %d", x, y);
+`, `fprintf(stderr, "Flag");
+fprintf(stderr, "X = %d\n", x);
+puts("The first, second, and third items.");
+((x>y)?puts("x>y"): printf("x is %d but y is %d", x, y));
+`},
+	}
+
+	for _, test := range tt {
+		expanded, err := NewParser(New(test.input)).Expand()
+		for _, e := range err {
+			t.Errorf(e.Error())
+		}
+		// directives leave empty lines behind
+		if out := strings.TrimLeft(expanded, "\n"); out != test.output {
+			t.Errorf("expected\n%s\ngot\n%s", test.output, out)
+		}
+	}
+}
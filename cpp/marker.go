@@ -0,0 +1,111 @@
+package cpp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gorilla/lex"
+)
+
+// up to this many empty lines are written out rather than a linemarker
+const maxBlank = 8
+
+// the text produced by Expand; lines left empty by directives and skipped
+// groups are held back so that, with linemarkers, a long run of them can
+// be replaced by a single marker
+type output struct {
+	buf     bytes.Buffer
+	markers bool
+	blank   int
+	// the line the text written last is followed by
+	next int
+	// for Stream the tokens of text lines and the pragmas are collected
+	// instead, and anything else is dropped; constants are read as lexed
+	// with lex
+	stream  bool
+	toks    []lex.Token
+	pragmas []Pragma
+	lex     lex.Options
+}
+
+// writes the tokens of a text line, which begins line of file name
+func (o *output) line(toks []Token, line int, name string) {
+	if o.stream {
+		o.convert(toks, line, name)
+		return
+	}
+	o.text(join(toks), line, name)
+}
+
+// writes a #pragma directive kept in the output, text being the tokens
+// following #pragma
+func (o *output) pragma(text string, line int, name string) {
+	if o.stream {
+		o.pragmas = append(o.pragmas, Pragma{Text: text, File: name, Line: line, Before: len(o.toks)})
+		return
+	}
+	o.text("#pragma "+text+"\n", line, name)
+}
+
+func (o *output) empty() {
+	o.blank++
+}
+
+// writes s, which begins line of file name, after the lines held back
+func (o *output) text(s string, line int, name string) {
+	if o.stream {
+		return
+	}
+	// lines joined by splices and comments are made up for as well
+	if gap := line - o.next; gap > o.blank {
+		o.blank = gap
+	}
+	if o.markers && o.blank > maxBlank {
+		o.sync(line, name)
+	}
+	for ; o.blank > 0; o.blank-- {
+		o.buf.WriteByte('\n')
+	}
+	o.buf.WriteString(s)
+	o.next = line + strings.Count(s, "\n")
+}
+
+// # line "name" flags, telling the next line is line of file name; the
+// lines held back are dropped. The flags are 1 when a file is entered, 2
+// when it is returned to and 3 for system headers. Without linemarkers
+// nothing is written.
+func (o *output) sync(line int, name string, flags ...string) {
+	o.next = line
+	if !o.markers {
+		return
+	}
+	o.blank = 0
+
+	// the last line of a file may lack its newline
+	if b := o.buf.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+		o.buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&o.buf, "# %d %s", line, quote(name))
+	for _, flag := range flags {
+		o.buf.WriteString(" " + flag)
+	}
+	o.buf.WriteByte('\n')
+}
+
+func (o *output) String() string {
+	if !o.markers || o.blank <= maxBlank {
+		for ; o.blank > 0; o.blank-- {
+			o.buf.WriteByte('\n')
+		}
+	}
+	return o.buf.String()
+}
+
+// the linemarker flags of the current file, first being 1 or 2
+func (p *Parser) markerFlags(first string) []string {
+	if p.system {
+		return []string{first, "3"}
+	}
+	return []string{first}
+}
@@ -0,0 +1,115 @@
+package cpp
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"gorilla/lex"
+	"gorilla/parse"
+)
+
+func TestLinemarkers(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.h":         {Data: []byte("int a;\n")},
+		"b.h":         {Data: []byte("#include \"a.h\"\nint b;\n")},
+		"noeol.h":     {Data: []byte("x")},
+		"sys/stdio.h": {Data: []byte("int printf();\n")},
+	}
+	opts := Options{
+		Filename:    "main.c",
+		FS:          fsys,
+		SystemDirs:  []string{"sys"},
+		Linemarkers: true,
+	}
+
+	tt := []Pair{
+		{"int x;\n", "# 1 \"main.c\"\nint x;\n"},
+		{"#include \"a.h\"\nint x;\n",
+			"# 1 \"main.c\"\n# 1 \"a.h\" 1\nint a;\n# 2 \"main.c\" 2\nint x;\n"},
+		{"\n#include \"b.h\"\n",
+			"# 1 \"main.c\"\n\n# 1 \"b.h\" 1\n# 1 \"a.h\" 1\nint a;\n# 2 \"b.h\" 2\nint b;\n# 3 \"main.c\" 2\n"},
+		{"#include <stdio.h>\n",
+			"# 1 \"main.c\"\n# 1 \"sys/stdio.h\" 1 3\nint printf();\n# 2 \"main.c\" 2\n"},
+		{"#include \"noeol.h\"\ny\n",
+			"# 1 \"main.c\"\n# 1 \"noeol.h\" 1\nx\n# 2 \"main.c\" 2\ny\n"},
+		// a few empty lines are kept, more are replaced by a marker
+		{"#if 0\n\n\n#endif\nx\n", "# 1 \"main.c\"\n\n\n\n\nx\n"},
+		{"#if 0\n" + strings.Repeat("\n", 10) + "#endif\nx\n",
+			"# 1 \"main.c\"\n# 13 \"main.c\"\nx\n"},
+		{"#line 100 \"foo.c\"\nx\n", "# 1 \"main.c\"\n# 100 \"foo.c\"\nx\n"},
+		{"#pragma foo\nx\n", "# 1 \"main.c\"\n#pragma foo\nx\n"},
+		// lines joined by a splice or a comment are made up for
+		{"a\\\nb\nc\n#if 0\n" + strings.Repeat("\n", 9) + "#endif\nd\n",
+			"# 1 \"main.c\"\nab\n\nc\n# 15 \"main.c\"\nd\n"},
+		{"a /*\n*/ b\nc\n", "# 1 \"main.c\"\na b\n\nc\n"},
+	}
+
+	for _, test := range tt {
+		check(t, NewParserOptions(New(test.input), opts), test.output)
+	}
+
+	// without the option nothing changes
+	opts.Linemarkers = false
+	p := NewParserOptions(New("#include \"b.h\"\n#if 0\n"+strings.Repeat("\n", 10)+"#endif\n"), opts)
+	check(t, p, "\n\nint a;\nint b;\n"+strings.Repeat("\n", 12))
+	check(t, NewParserOptions(New("#define A \\\n 1\nA\n"), opts), "\n\n1\n")
+}
+
+func TestLinemarkersLexed(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.h": {Data: []byte("\nint\na;\n")},
+	}
+	opts := Options{Filename: "main.c", FS: fsys, Linemarkers: true}
+	src := "#include \"a.h\"\n#if 0\n" + strings.Repeat("\n", 10) + "#endif\nint b;\nint \\\nc;\nd;\n"
+
+	out, err := NewParserOptions(New(src), opts).Expand()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		file string
+		line uint
+	}{
+		{"a.h", 2},
+		{"a.h", 3},
+		{"a.h", 3},
+		{"main.c", 14},
+		{"main.c", 14},
+		{"main.c", 14},
+		{"main.c", 15},
+		{"main.c", 15},
+		{"main.c", 15},
+		{"main.c", 17},
+	}
+	l := lex.New(out)
+	for i, w := range want {
+		tok := l.Lex()
+		if tok.File != w.file || tok.Line != w.line {
+			t.Errorf("expected %s:%d for token %d, got %s:%d",
+				w.file, w.line, i, tok.File, tok.Line)
+		}
+	}
+}
+
+func TestLinemarkersAdjacentStrings(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.h": {Data: []byte("\"b\"\n")},
+	}
+	opts := Options{Filename: "m.c", FS: fsys, Linemarkers: true}
+	src := "s = \"a\"\n#if 0\n" + strings.Repeat("\n", 10) + "#endif\n\"b\"\n#include \"a.h\"\n;\n"
+
+	out, err := NewParserOptions(New(src), opts).Expand()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	tree, errs := parse.New(lex.New(out)).Parse()
+	for _, e := range errs {
+		t.Error(e)
+	}
+	if len(tree) != 1 || tree[0].String() != `(s = "abb")` {
+		t.Errorf("unexpected tree %v", tree)
+	}
+}
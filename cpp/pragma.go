@@ -0,0 +1,222 @@
+package cpp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// handles a pragma of the namespace it was registered for, args are the
+// tokens following the namespace with the surrounding whitespace removed.
+// The pragma is left in the output when keep is set.
+type PragmaHandler func(p *Parser, args []Token) (keep bool, err error)
+
+// attaches h to the pragmas whose first token is namespace, replacing any
+// handler registered before, including the builtin ones; pragmas without a
+// handler are left in the output
+func (p *Parser) RegisterPragma(namespace string, h PragmaHandler) {
+	p.pragmas[namespace] = h
+}
+
+// the alignment set by #pragma pack, 0 when none is in effect
+func (p *Parser) Packing() int {
+	return p.align
+}
+
+func (p *Parser) registerBuiltinPragmas() {
+	p.RegisterPragma("once", (*Parser).pragmaOnce)
+	p.RegisterPragma("pack", (*Parser).pragmaPack)
+	p.RegisterPragma("push_macro", (*Parser).pragmaPushMacro)
+	p.RegisterPragma("pop_macro", (*Parser).pragmaPopMacro)
+}
+
+// runs the handler of a pragma, reporting whether it is kept
+func (p *Parser) pragma(toks []Token) bool {
+	toks = trimWS(toks)
+	if len(toks) == 0 || !isIdent(toks[0]) {
+		return true
+	}
+
+	h, ok := p.pragmas[toks[0].Literal]
+	if !ok {
+		return true
+	}
+
+	keep, err := h(p, trimWS(toks[1:]))
+	if err != nil {
+		p.error("%s", err)
+		return false
+	}
+	return keep
+}
+
+// _Pragma ( string-literal ): the string is destringized and handled as
+// the tokens of a #pragma. A pragma that is kept stays in the output as
+// the operator, which is not run again when rescanned.
+func (p *Parser) pragmaOperator(tok Token) []Token {
+	lines := p.openParen()
+	if lines < 0 {
+		p.error("_Pragma takes a parenthesized string literal")
+		return []Token{tok}
+	}
+
+	op := []Token{tok, {Type: PUNCT, Literal: "("}}
+	for op[len(op)-1].Type != RPAREN {
+		if len(p.queue) == 0 && !p.fill() {
+			p.error("unterminated _Pragma")
+			return nil
+		}
+		tok := p.pop()
+		if tok.Type == NEWLINE {
+			lines++
+			tok = Token{Type: WS, Literal: " "}
+		}
+		op = append(op, tok)
+	}
+	p.push(nil, lines)
+
+	args := trimWS(op[2 : len(op)-1])
+	if len(args) != 1 || args[0].Type != STRING {
+		p.error("_Pragma takes a parenthesized string literal")
+		return nil
+	}
+
+	// the encoding prefix and the quotes are deleted, \" and \\ are
+	// replaced by " and \
+	lit := args[0].Literal
+	if !p.pragma(tokenize(unquote(lit[strings.IndexByte(lit, '"'):]))) {
+		return nil
+	}
+
+	op[0].Hide = op[0].Hide.add("_Pragma")
+	return op
+}
+
+// #pragma once: the file is not read again by #include
+func (p *Parser) pragmaOnce(args []Token) (bool, error) {
+	if len(args) != 0 {
+		return false, errors.New("extra tokens at end of #pragma once")
+	}
+	p.once[p.name] = true
+	return false, nil
+}
+
+// #pragma pack(), pack(n), pack(push), pack(push, n) and pack(pop); the
+// pragma is kept for the compiler, the alignment is tracked by Packing
+func (p *Parser) pragmaPack(args []Token) (bool, error) {
+	malformed := errors.New("malformed #pragma pack")
+
+	args = significant(args)
+	if len(args) < 2 || args[0].Literal != "(" ||
+		args[len(args)-1].Type != RPAREN {
+		return false, malformed
+	}
+	args = args[1 : len(args)-1]
+
+	push := false
+	if len(args) > 0 && isIdent(args[0]) {
+		switch args[0].Literal {
+		case "push":
+			push = true
+		case "pop":
+			if len(args) != 1 {
+				return false, malformed
+			}
+			if len(p.packs) == 0 {
+				return false, errors.New("#pragma pack(pop) without matching #pragma pack(push)")
+			}
+			p.align = p.packs[len(p.packs)-1]
+			p.packs = p.packs[:len(p.packs)-1]
+			return true, nil
+		default:
+			return false, malformed
+		}
+
+		args = args[1:]
+		if len(args) > 0 {
+			if args[0].Type != COMMA {
+				return false, malformed
+			}
+			args = args[1:]
+		}
+	}
+
+	align := 0
+	switch {
+	case len(args) > 1:
+		return false, malformed
+	case len(args) == 1:
+		switch args[0].Literal {
+		case "1", "2", "4", "8", "16":
+			align, _ = strconv.Atoi(args[0].Literal)
+		default:
+			return false, fmt.Errorf("alignment must be a small power of two, not %s",
+				args[0].Literal)
+		}
+	}
+
+	if push {
+		p.packs = append(p.packs, p.align)
+		if align == 0 {
+			return true, nil
+		}
+	}
+	p.align = align
+
+	return true, nil
+}
+
+// #pragma push_macro("NAME") saves the definition of NAME, or the lack of
+// one, to be restored by the matching #pragma pop_macro("NAME")
+func (p *Parser) pragmaPushMacro(args []Token) (bool, error) {
+	name, err := pragmaMacroName("push_macro", args)
+	if err != nil {
+		return false, err
+	}
+	p.pushed[name] = append(p.pushed[name], p.macros[name])
+	return false, nil
+}
+
+// a pop_macro without push_macro leaves the macro alone
+func (p *Parser) pragmaPopMacro(args []Token) (bool, error) {
+	name, err := pragmaMacroName("pop_macro", args)
+	if err != nil {
+		return false, err
+	}
+
+	saved := p.pushed[name]
+	if len(saved) == 0 {
+		return false, nil
+	}
+	m := saved[len(saved)-1]
+	p.pushed[name] = saved[:len(saved)-1]
+
+	if m == nil {
+		delete(p.macros, name)
+	} else {
+		p.macros[name] = m
+	}
+	return false, nil
+}
+
+// ( "NAME" )
+func pragmaMacroName(pragma string, args []Token) (string, error) {
+	args = significant(args)
+	if len(args) != 3 || args[0].Literal != "(" || args[1].Type != STRING ||
+		!strings.HasPrefix(args[1].Literal, `"`) || args[2].Type != RPAREN {
+		return "", fmt.Errorf("invalid #pragma %s directive", pragma)
+	}
+	return unquote(args[1].Literal), nil
+}
+
+// toks without whitespace
+func significant(toks []Token) []Token {
+	out := []Token{}
+	for _, tok := range toks {
+		if tok.Type != WS {
+			out = append(out, tok)
+		}
+	}
+	return out
+}
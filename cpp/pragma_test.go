@@ -0,0 +1,116 @@
+package cpp
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPragma(t *testing.T) {
+	tt := []Pair{
+		{"#pragma weak foo\n", "#pragma weak foo\n"},
+		{"#pragma STDC FP_CONTRACT ON\n", "#pragma STDC FP_CONTRACT ON\n"},
+		{"#pragma\n", "#pragma \n"},
+		// the tokens of a pragma are not expanded
+		{"#define X 1\n#pragma foo X\n", "\n#pragma foo X\n"},
+		{"#pragma pack(push, 4)\n", "#pragma pack(push, 4)\n"},
+		{"#define X 1\n#pragma push_macro(\"X\")\n#undef X\nX\n#pragma pop_macro(\"X\")\nX\n",
+			"\n\n\nX\n\n1\n"},
+		{"#define X 1\n#pragma push_macro(\"X\")\n#undef X\n#define X 2\nX\n#pragma pop_macro(\"X\")\nX\n",
+			"\n\n\n\n2\n\n1\n"},
+		{"#pragma push_macro(\"Y\")\n#define Y 1\nY\n#pragma pop_macro(\"Y\")\nY\n",
+			"\n\n1\n\nY\n"},
+		{"#define X 1\n#pragma pop_macro(\"X\")\nX\n", "\n\n1\n"},
+		{"_Pragma(\"foo bar\") x\n", "_Pragma(\"foo bar\") x\n"},
+		{"#define X 1\n_Pragma(\"push_macro(\\\"X\\\")\") _Pragma ( \"pop_macro(\\\"X\\\")\" ) X\n",
+			"\n  1\n"},
+		{"#define P(x) _Pragma(#x) x\nP(foo)\n", "\n_Pragma(\"foo\") foo\n"},
+		{"#define DO_PRAGMA(x) _Pragma (#x)\nDO_PRAGMA(push_macro(\"A\")) a\n", "\n a\n"},
+		{"_Pragma\n(\n\"foo\")\n", "_Pragma( \"foo\")\n\n\n"},
+		{"_Pragma(L\"foo\")\n", "_Pragma(L\"foo\")\n"},
+	}
+
+	checkAll(t, tt)
+
+	errs := []string{
+		"#pragma once x\n",
+		"#pragma pack\n",
+		"#pragma pack(3)\n",
+		"#pragma pack(push 2)\n",
+		"#pragma pack(pop)\n",
+		"#pragma push_macro(X)\n",
+		"#pragma pop_macro(\"X\"\n",
+		"_Pragma\n",
+		"_Pragma(foo)\n",
+		"_Pragma(\"a\" \"b\")\n",
+		"_Pragma(\"foo\"\n",
+		"_Pragma(\"pack(\")\n",
+	}
+	for _, src := range errs {
+		if _, err := NewParser(New(src)).Expand(); len(err) == 0 {
+			t.Errorf("no error reported for %q", src)
+		}
+	}
+}
+
+func TestPragmaPack(t *testing.T) {
+	tt := []struct {
+		pragmas string
+		align   int
+	}{
+		{"", 0},
+		{"#pragma pack(4)\n", 4},
+		{"#pragma pack(4)\n#pragma pack()\n", 0},
+		{"#pragma pack(push, 2)\n", 2},
+		{"#pragma pack(8)\n#pragma pack(push)\n", 8},
+		{"#pragma pack(8)\n#pragma pack(push, 1)\n#pragma pack(pop)\n", 8},
+		{"#pragma pack(push, 1)\n#pragma pack(push, 2)\n#pragma pack(pop)\n", 1},
+		{"_Pragma(\"pack(16)\")\n", 16},
+	}
+
+	for _, test := range tt {
+		p := NewParser(New(test.pragmas))
+		if _, err := p.Expand(); len(err) != 0 {
+			t.Errorf("%q: %v", test.pragmas, err)
+		} else if p.Packing() != test.align {
+			t.Errorf("%q: expected alignment %d, got %d",
+				test.pragmas, test.align, p.Packing())
+		}
+	}
+}
+
+func TestRegisterPragma(t *testing.T) {
+	var seen []string
+	gorilla := func(p *Parser, args []Token) (bool, error) {
+		if len(args) == 0 {
+			return false, errors.New("empty gorilla pragma")
+		}
+		seen = append(seen, join(args))
+		return args[0].Literal == "keep", nil
+	}
+
+	src := "#pragma gorilla inline  f\n_Pragma(\"gorilla keep\")\n#pragma  gorilla\n"
+	p := NewParser(New(src))
+	p.RegisterPragma("gorilla", gorilla)
+	_, err := p.Expand()
+
+	if len(err) != 1 || err[0].Error() != "line 3: empty gorilla pragma" {
+		t.Errorf("expected the handler's error on line 3, got %v", err)
+	}
+	if len(seen) != 2 || seen[0] != "inline f" || seen[1] != "keep" {
+		t.Errorf("handler called with %q", seen)
+	}
+
+	p = NewParser(New("#pragma gorilla keep\n#pragma gorilla drop\n"))
+	p.RegisterPragma("gorilla", gorilla)
+	check(t, p, "#pragma gorilla keep\n\n")
+
+	// builtin handlers can be replaced
+	fsys := fstest.MapFS{"once.h": {Data: []byte("#pragma once\nx\n")}}
+	p = NewParserOptions(New("#include \"once.h\"\n#include \"once.h\"\n"),
+		Options{FS: fsys})
+	p.RegisterPragma("once", func(p *Parser, args []Token) (bool, error) {
+		return true, nil
+	})
+	check(t, p, "\n#pragma once\nx\n\n#pragma once\nx\n")
+}
@@ -1,6 +1,6 @@
 package cpp
 
-import "bytes"
+import "strings"
 
 var trigraph_map = map[byte]byte{
 	'=':  '#',
@@ -14,155 +14,178 @@ var trigraph_map = map[byte]byte{
 	'-':  '~',
 }
 
+// the source as rewritten by the first translation phases, along with the
+// offset in the original source every byte comes from
+type text struct {
+	buf []byte
+	off []int
+}
+
+func (t *text) put(c byte, off int) {
+	t.buf = append(t.buf, c)
+	t.off = append(t.off, off)
+}
+
 func pre(input string) string {
-	return strip(splice(trigraph(input)))
+	return string(translate(input, false).buf)
 }
 
-// phase 1: replace all trigraphs
-func trigraph(input string) string {
-	var out bytes.Buffer
-	l := len(input)
+// phases 1 to 3, with ' separating the digits of pp-numbers in c23
+func translate(input string, c23 bool) text {
+	t := text{buf: []byte(input), off: make([]int, len(input))}
+	for i := range t.off {
+		t.off[i] = i
+	}
+
+	return strip(splice(trigraph(t)), c23)
+}
+
+// phase 1: replace all trigraphs, which take the place of their first '?'
+func trigraph(input text) text {
+	var out text
+	in := input.buf
+	l := len(in)
 
 	for i := 0; i < l; i++ {
-		c := input[i]
+		c := in[i]
 
 		if c == '?' {
 			if i+1 >= l {
-				out.WriteByte(c)
+				out.put(c, input.off[i])
 				continue
 			}
 
 			i++
-			nc := input[i]
+			nc := in[i]
 			if i+1 >= l || nc != '?' {
-				out.WriteByte(c)
-				out.WriteByte(nc)
+				out.put(c, input.off[i-1])
+				out.put(nc, input.off[i])
 				continue
 			}
 
 			i++
-			nnc := input[i]
+			nnc := in[i]
 			if mapped, ok := trigraph_map[nnc]; ok {
-				out.WriteByte(mapped)
+				out.put(mapped, input.off[i-2])
 				continue
 			}
 
-			out.WriteByte(c)
-			out.WriteByte(nc)
-			out.WriteByte(nnc)
+			// the second '?' may begin a trigraph itself
+			out.put(c, input.off[i-2])
+			i -= 2
 			continue
 		}
 
-		out.WriteByte(c)
+		out.put(c, input.off[i])
 	}
 
-	return out.String()
+	return out
 }
 
 // phase 2: backslashes immediately followed by newlines are removed
-func splice(input string) string {
-	var out bytes.Buffer
-	l := len(input)
+func splice(input text) text {
+	var out text
+	in := input.buf
+	l := len(in)
 
 	for i := 0; i < l; i++ {
-		c := input[i]
+		c := in[i]
 
 		if c == '\\' {
 			if i+1 >= l {
-				out.WriteByte(c)
+				out.put(c, input.off[i])
 				continue
 			}
 
 			i++
-			nc := input[i]
+			nc := in[i]
 			if nc == '\n' {
 				continue
 			}
 
-			out.WriteByte(c)
-			out.WriteByte(nc)
+			out.put(c, input.off[i-1])
+			out.put(nc, input.off[i])
 			continue
 		}
 
-		out.WriteByte(c)
+		out.put(c, input.off[i])
 	}
 
-	return out.String()
+	return out
 }
 
-// phase 3.1: comments are replaced with one space
-func strip(input string) string {
-	var out bytes.Buffer
-	l := len(input)
+// phase 3.1: comments are replaced with one space, which takes the place
+// of the comment's first '/'; the newline ending a // comment is kept,
+// and string literals and character constants are left alone
+func strip(input text, c23 bool) text {
+	var out text
+	in := input.buf
+	l := len(in)
 
 	for i := 0; i < l; i++ {
-		c := input[i]
-
-		if c == '/' {
-			if i+1 >= l {
-				out.WriteByte(c)
-				continue
-			}
-
-			i++
-			nc := input[i]
-			if nc == '/' {
+		c := in[i]
+
+		switch {
+		case c == '\'' && c23 && i+1 < l && isWordByte(in[i+1]) && inNumber(out.buf):
+			out.put(c, input.off[i])
+		case c == '"' || c == '\'':
+			out.put(c, input.off[i])
+			for i+1 < l && in[i+1] != c && in[i+1] != '\n' {
 				i++
-				if i+1 >= l {
-					out.WriteByte(' ')
-					continue
-				}
-
-				for {
+				out.put(in[i], input.off[i])
+				if in[i] == '\\' && i+1 < l && in[i+1] != '\n' {
 					i++
-					if i+1 >= l {
-						out.WriteByte(' ')
-						break
-					} else if nnc := input[i]; nnc == '\n' {
-						out.WriteByte(' ')
-						break
-					}
+					out.put(in[i], input.off[i])
 				}
-				continue
-			} else if nc == '*' {
+			}
+			if i+1 < l && in[i+1] == c {
 				i++
-				if i+1 >= l {
-					out.WriteByte(' ')
-					continue
-				}
-
-				for {
-					i++
-					if i+1 >= l {
-						out.WriteByte(' ')
-						break
-					}
-
-					nnc := input[i]
-					i++
-
-					if i+1 >= l {
-						out.WriteByte(' ')
-						break
-					}
-
-					nnnc := input[i]
-
-					if nnc == '*' && nnnc == '/' {
-						out.WriteByte(' ')
-						break
-					}
-				}
-				continue
+				out.put(c, input.off[i])
 			}
-
-			out.WriteByte(c)
-			out.WriteByte(nc)
-			continue
+		case c == '/' && i+1 < l && in[i+1] == '/':
+			out.put(' ', input.off[i])
+			for i+1 < l && in[i+1] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < l && in[i+1] == '*':
+			out.put(' ', input.off[i])
+			i += 2
+			for i < l && !(in[i] == '*' && i+1 < l && in[i+1] == '/') {
+				i++
+			}
+			i++
+		default:
+			out.put(c, input.off[i])
 		}
+	}
+
+	return out
+}
 
-		out.WriteByte(c)
+// buf ends with a pp-number, which a digit separator may continue
+func inNumber(buf []byte) bool {
+	i := len(buf)
+	for i > 0 {
+		c := buf[i-1]
+		switch {
+		case isWordByte(c) || c == '.' || c == '\'':
+		case (c == '+' || c == '-') && i > 1 && strings.IndexByte("eEpP", buf[i-2]) >= 0:
+			i--
+		default:
+			return i < len(buf) && startsNumber(buf[i:])
+		}
+		i--
 	}
+	return i < len(buf) && startsNumber(buf[i:])
+}
+
+// a pp-number begins with a digit, or a '.' followed by one
+func startsNumber(b []byte) bool {
+	return b[0] >= '0' && b[0] <= '9' || b[0] == '.' && len(b) > 1 && b[1] >= '0' && b[1] <= '9'
+}
 
-	return out.String()
+// letters, digits, '_' and the bytes of non-ASCII characters
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c >= 0x80
 }
@@ -14,14 +14,131 @@ func TestTrigraph(t *testing.T) {
 	if out := pre(input); out != `# \ ^ [ ] | { } ~` {
 		t.Errorf(`expected "# \ ^ [ ] | { } ~", got="%s"`, out)
 	}
+	if out := pre("???=??x"); out != "?#??x" {
+		t.Errorf(`expected "?#??x", got="%s"`, out)
+	}
+}
+
+// digraphs are tokens rather than a translation phase, they keep their
+// spelling and only %: and %:%: differ in meaning from punctuators
+func TestDigraph(t *testing.T) {
+	l := New("<: :> <% %> %: %:%: %= <:: %:%")
+	tt := []struct {
+		ttype   uint
+		literal string
+	}{
+		{PUNCT, "<:"}, {PUNCT, ":>"}, {PUNCT, "<%"}, {PUNCT, "%>"},
+		{HASH, "%:"}, {HASHHASH, "%:%:"}, {PUNCT, "%="},
+		{PUNCT, "<:"}, {PUNCT, ":"}, {HASH, "%:"}, {PUNCT, "%"},
+	}
+	for _, test := range tt {
+		tok := l.Lex()
+		for tok.Type == WS {
+			tok = l.Lex()
+		}
+		if tok.Type != test.ttype || tok.Literal != test.literal {
+			t.Errorf("expected %s %q, got %s %q", toks(test.ttype), test.literal,
+				toks(tok.Type), tok.Literal)
+		}
+	}
+
+	checkAll(t, []Pair{
+		{"%:define A 1\nA", "\n1"},
+		{"  %: ifdef A\na\n%:else\nb\n%:endif\n", "\n\n\nb\n\n"},
+		{"%:define s(x) %:x\ns(<: %> %:%:)", "\n\"<: %> %:%:\""},
+		{"%:define cat(a, b) a %:%: b\ncat(x, y)", "\nxy"},
+		{"%:define s(x) %:x\n%:define h(a, b) s(a %:%: b)\nh(%:, %:)", "\n\n\"%:%:\""},
+		{"a<:1:> = <%0%>;", "a<:1:> = <%0%>;"},
+	})
 }
 
 func TestStrip(t *testing.T) {
-	if out := pre("//abc\n"); out != " " {
+	if out := pre("//abc\n"); out != " \n" {
 		t.Errorf("single line comment not stripped")
 	} else if out = pre("/*abc\nabc*/"); out != " " {
 		t.Errorf("multi line comment not stripped")
-	} else if out = pre("// /*abc\n //// /* // */"); out != "   " {
+	} else if out = pre("// /*abc\n //// /* // */"); out != " \n  " {
 		t.Errorf("mixed single line and multi line comment not stripped")
+	} else if out = pre("a/**/b/*/ c */d/* unterminated"); out != "a b d " {
+		t.Errorf("comments not delimited correctly, got %q", out)
+	}
+
+	// comment delimiters inside of literals are not comments
+	tt := []string{
+		`"// not a comment"`,
+		`"/* not */ a comment"`,
+		`'//'`,
+		`"\" /* still a string */"`,
+		`L"//"`,
+	}
+	for _, input := range tt {
+		if out := pre(input); out != input {
+			t.Errorf("expected %q to be left alone, got %q", input, out)
+		}
+	}
+	if out := pre("\"abc\n// x"); out != "\"abc\n " {
+		t.Errorf("an unterminated string ends at the newline, got %q", out)
+	}
+}
+
+func TestStripC23(t *testing.T) {
+	// a digit separator does not begin a character constant
+	tt := []Pair{
+		{"int x = 1'000; // it's\n", "int x = 1'000;  \n"},
+		{"#if 1'000 == 1000 // x'y", "#if 1'000 == 1000  "},
+		{"int x = 1'000; /* a */ int y = 2'0; /* b */", "int x = 1'000;   int y = 2'0;  "},
+		{"x1'a' u8'b' .5'0 1e+1'0", "x1'a' u8'b' .5'0 1e+1'0"},
+	}
+	for _, test := range tt {
+		if out := string(translate(test.input, true).buf); out != test.output {
+			t.Errorf("%q: expected %q, got %q", test.input, test.output, out)
+		}
+	}
+	if out := pre("1'0 // '"); out != "1'0 // '" {
+		t.Errorf("separators are only known to C23, got %q", out)
+	}
+
+	opts := Options{Std: C23}
+	check(t, NewParserOptions(New("int x = 1'000; // it's\n"), opts), "int x = 1'000; \n")
+	check(t, NewParserOptions(New("int x = 1'000; /* a */ int y = 2'0; /* b */"), opts),
+		"int x = 1'000; int y = 2'0; ")
+}
+
+func TestPositions(t *testing.T) {
+	src := "a /* c\n */ b\\\n c ??= d\ne\\\nf \"é\" g\n\t// x\nh"
+	tt := []struct {
+		literal string
+		pos     Pos
+	}{
+		{"a", Pos{0, 1, 1}},
+		{" ", Pos{1, 1, 2}},
+		{"b", Pos{11, 2, 5}},
+		{" ", Pos{14, 3, 1}},
+		{"c", Pos{15, 3, 2}},
+		{" ", Pos{16, 3, 3}},
+		{"#", Pos{17, 3, 4}},
+		{" ", Pos{20, 3, 7}},
+		{"d", Pos{21, 3, 8}},
+		{"\n", Pos{22, 3, 9}},
+		// the splice joins e and f into one identifier
+		{"ef", Pos{23, 4, 1}},
+		{" ", Pos{27, 5, 2}},
+		{`"é"`, Pos{28, 5, 3}},
+		{" ", Pos{32, 5, 6}},
+		{"g", Pos{33, 5, 7}},
+		{"\n", Pos{34, 5, 8}},
+		{" ", Pos{35, 6, 1}},
+		{"\n", Pos{40, 6, 6}},
+		{"h", Pos{41, 7, 1}},
+		{"", Pos{42, 7, 2}},
+	}
+
+	l := New(src)
+	for i, test := range tt {
+		tok := l.Lex()
+		if tok.Literal != test.literal || tok.Pos != test.pos {
+			t.Errorf("expected %q at %v for tt[%d], got %q at %v",
+				test.literal, test.pos, i, tok.Literal, tok.Pos)
+		}
 	}
 }
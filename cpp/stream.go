@@ -0,0 +1,160 @@
+package cpp
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"gorilla/lex"
+)
+
+// the preprocessed tokens of a translation unit, ready for the C parser
+type Stream struct {
+	toks    []lex.Token
+	pos     int
+	pragmas []Pragma
+}
+
+// a pragma left in the output by its handler, or having none
+type Pragma struct {
+	// the tokens following #pragma, or the destringized operand of _Pragma
+	Text string
+	File string
+	Line int
+	// the number of tokens of the stream coming before the pragma
+	Before int
+}
+
+// preprocesses like Expand, but the result is kept as tokens converted
+// for the C parser; pragmas that are kept are set aside with the place
+// they were found at, and linemarkers are not needed since every token
+// tells the file and line it comes from
+func (p *Parser) Stream() (*Stream, []error) {
+	out := &output{stream: true, lex: lex.Options{C23: p.opts.Std == C23}}
+	p.run(out)
+
+	if len(p.err) != 0 {
+		return nil, p.err
+	}
+	toks, index := concat(out.toks, out.lex)
+	for i := range out.pragmas {
+		out.pragmas[i].Before = index[out.pragmas[i].Before]
+	}
+	return &Stream{toks: toks, pragmas: out.pragmas}, nil
+}
+
+// adjacent string literals, still spelled as written, are concatenated and
+// decoded by the C lexer as translation phase 6 says; index maps the
+// position of a token in toks, or len(toks), to its position in the result
+func concat(toks []lex.Token, opts lex.Options) (out []lex.Token, index []int) {
+	out = []lex.Token{}
+	index = make([]int, len(toks)+1)
+
+	for i := 0; i < len(toks); {
+		if toks[i].Type != lex.STRING {
+			index[i] = len(out)
+			out = append(out, toks[i])
+			i++
+			continue
+		}
+
+		j := i
+		spelled := []string{}
+		for ; j < len(toks) && toks[j].Type == lex.STRING; j++ {
+			index[j] = len(out)
+			spelled = append(spelled, toks[j].Literal)
+		}
+
+		t := toks[i]
+		c := lex.Constant(strings.Join(spelled, " "), opts)
+		t.Type, t.Literal, t.Units, t.Prefix = c.Type, c.Literal, c.Units, c.Prefix
+		t.End = toks[j-1].End
+		out = append(out, t)
+		i = j
+	}
+	index[len(toks)] = len(out)
+
+	return out, index
+}
+
+// the next token, EOF once all of them have been read
+func (s *Stream) Lex() lex.Token {
+	if s.pos >= len(s.toks) {
+		return lex.Token{Type: lex.EOF}
+	}
+	s.pos++
+	return s.toks[s.pos-1]
+}
+
+// the pragmas kept in the output, in the order they were found
+func (s *Stream) Pragmas() []Pragma {
+	return s.pragmas
+}
+
+// turns the preprocessing tokens of a text line, which begins line of
+// file name, into tokens of the C lexer: whitespace is dropped, keywords
+// are recognized and pp-numbers become integer or floating constants. The
+// _Pragma operators kept in the line are set aside.
+func (o *output) convert(toks []Token, line int, name string) {
+
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		t := lex.Token{Line: uint(line), File: name, Literal: tok.Literal}
+		t.Start = lex.Pos{Line: t.Line, File: name}
+		// only tokens read from the file know where they were written,
+		// the ones coming from a replacement list just the line
+		if len(tok.Hide) == 0 && tok.Pos.Line > 0 {
+			t.Col = uint(tok.Pos.Col)
+			t.Start.Offset, t.Start.Col = tok.Pos.Offset, t.Col
+		}
+		t.End = t.Start
+		if t.Col > 0 {
+			t.End.Offset += len(tok.Literal)
+			t.End.Col += uint(utf8.RuneCountInString(tok.Literal))
+		}
+
+		// a _Pragma operator that was kept in the output
+		if tok.Hide.Has("_Pragma") && tok.Literal == "_Pragma" {
+			for toks[i].Type != STRING {
+				i++
+			}
+			lit := toks[i].Literal
+			o.pragma(unquote(lit[strings.IndexByte(lit, '"'):]), line, name)
+			for toks[i].Type != RPAREN {
+				i++
+			}
+			continue
+		}
+
+		switch tok.Type {
+		case WS, ERR:
+			// errors have been reported with the line already
+			continue
+		case NEWLINE:
+			line++
+			continue
+		case PPNUM, CHAR_CONST:
+			c := lex.Constant(tok.Literal, o.lex)
+			t.Type, t.Literal, t.Value, t.Float, t.Suffix, t.Prefix =
+				c.Type, c.Literal, c.Value, c.Float, c.Suffix, c.Prefix
+		case STRING:
+			// decoded once the literals adjacent to it are known
+			t.Type = lex.STRING
+		case HASH, HASHHASH, OTHER:
+			t.Type = lex.ERR
+			t.Literal = fmt.Sprintf("stray '%s' in program", tok.Literal)
+		default:
+			if isIdent(tok) {
+				if t.Type = lex.Lookup(tok.Literal); t.Type != lex.IDENT {
+					t.Literal = ""
+				}
+			} else if t.Type = lex.Punctuator(tok.Literal); t.Type == lex.ERR {
+				t.Literal = fmt.Sprintf("unknown token %s", tok.Literal)
+			} else {
+				t.Literal = ""
+			}
+		}
+
+		o.toks = append(o.toks, t)
+	}
+}
@@ -0,0 +1,206 @@
+package cpp
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"gorilla/lex"
+	"gorilla/parse"
+)
+
+func TestStream(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.h": {Data: []byte("#define N 10\nint\nn;\n")},
+	}
+	src := "#include \"a.h\"\n#pragma weak n\nwhile (n < N) n = n + 1.5e0;\n" +
+		"_Pragma(\"foo\") x = 0x1p3 + 'a' + \"s\";\n#define f(a) \\\n a\nf(\n1\n)\ny;\n"
+	p := NewParserOptions(New(src), Options{Filename: "main.c", FS: fsys})
+	s, err := p.Stream()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		ttype   uint
+		literal string
+		file    string
+		line    uint
+	}{
+		{lex.INT, "", "a.h", 2},
+		{lex.IDENT, "n", "a.h", 3},
+		{lex.SCOLON, "", "a.h", 3},
+		{lex.WHILE, "", "main.c", 3},
+		{lex.LPAREN, "", "main.c", 3},
+		{lex.IDENT, "n", "main.c", 3},
+		{lex.LT, "", "main.c", 3},
+		{lex.INT_CONST, "10", "main.c", 3},
+		{lex.RPAREN, "", "main.c", 3},
+		{lex.IDENT, "n", "main.c", 3},
+		{lex.ASSIGN, "", "main.c", 3},
+		{lex.IDENT, "n", "main.c", 3},
+		{lex.ADD, "", "main.c", 3},
+		{lex.FLOAT_CONST, "1.5e0", "main.c", 3},
+		{lex.SCOLON, "", "main.c", 3},
+		{lex.IDENT, "x", "main.c", 4},
+		{lex.ASSIGN, "", "main.c", 4},
+		{lex.FLOAT_CONST, "0x1p3", "main.c", 4},
+		{lex.ADD, "", "main.c", 4},
+		{lex.CHAR_CONST, "'a'", "main.c", 4},
+		{lex.ADD, "", "main.c", 4},
+		{lex.STRING, "s", "main.c", 4},
+		{lex.SCOLON, "", "main.c", 4},
+		{lex.INT_CONST, "1", "main.c", 7},
+		{lex.IDENT, "y", "main.c", 10},
+		{lex.SCOLON, "", "main.c", 10},
+		{lex.EOF, "", "", 0},
+	}
+
+	for i, test := range tt {
+		tok := s.Lex()
+		if tok.Type != test.ttype || tok.Literal != test.literal {
+			t.Errorf("expected %s %q at tt[%d], got %s %q", lex.Tmap[test.ttype],
+				test.literal, i, lex.Tmap[tok.Type], tok.Literal)
+		}
+		if tok.File != test.file || tok.Line != test.line {
+			t.Errorf("expected %s:%d at tt[%d], got %s:%d",
+				test.file, test.line, i, tok.File, tok.Line)
+		}
+	}
+
+	// pragmas without a handler are set aside with their place
+	pragmas := []Pragma{
+		{Text: "weak n", File: "main.c", Line: 2, Before: 3},
+		{Text: "foo", File: "main.c", Line: 4, Before: 15},
+	}
+	if got := s.Pragmas(); len(got) != len(pragmas) {
+		t.Errorf("expected pragmas %v, got %v", pragmas, got)
+	} else {
+		for i := range pragmas {
+			if got[i] != pragmas[i] {
+				t.Errorf("expected %v at pragmas[%d], got %v", pragmas[i], i, got[i])
+			}
+		}
+	}
+}
+
+func TestStreamOperators(t *testing.T) {
+	s, err := NewParser(New("#define N 2\nx = 1+N*3-1;\n")).Stream()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	tree, err := parse.New(s).Parse()
+	for _, e := range err {
+		t.Error(e)
+	}
+	if len(tree) != 1 || tree[0].String() != "(x = ((1 + (2 * 3)) - 1))" {
+		t.Errorf("unexpected tree %v", tree)
+	}
+}
+
+func TestStreamParse(t *testing.T) {
+	src := "#define SQUARE(x) ((x) * (x))\n#define A 1 + 2\nSQUARE(A);\n"
+	s, err := NewParser(New(src)).Stream()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	tree, err := parse.New(s).Parse()
+	for _, e := range err {
+		t.Error(e)
+	}
+	if len(tree) != 1 || tree[0].String() != "((1 + 2) * (1 + 2))" {
+		t.Errorf("unexpected tree %v", tree)
+	}
+
+	// left for the C parser to report
+	s, err = NewParser(New("#define A #\nA\n")).Stream()
+	if tok := s.Lex(); len(err) != 0 || tok.Type != lex.ERR {
+		t.Errorf("expected a stray '#', got %s and %v", lex.Tmap[tok.Type], err)
+	}
+}
+
+func TestStreamPositions(t *testing.T) {
+	p := NewParser(New("#define N 10\nint\tx = N; \"é\";"))
+	s, err := p.Stream()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	at := func(off int, line, col uint) lex.Pos {
+		return lex.Pos{Offset: off, Line: line, Col: col}
+	}
+	// tokens of a replacement list only know their line
+	tt := []struct {
+		start, end lex.Pos
+	}{
+		{at(13, 2, 1), at(16, 2, 4)},
+		{at(17, 2, 5), at(18, 2, 6)},
+		{at(19, 2, 7), at(20, 2, 8)},
+		{at(0, 2, 0), at(0, 2, 0)},
+		{at(22, 2, 10), at(23, 2, 11)},
+		{at(24, 2, 12), at(28, 2, 15)},
+	}
+	for i, test := range tt {
+		tok := s.Lex()
+		if tok.Start != test.start || tok.End != test.end || tok.Col != test.start.Col {
+			t.Errorf("expected %v-%v at tt[%d], got %v-%v",
+				test.start, test.end, i, tok.Start, tok.End)
+		}
+	}
+}
+
+func TestStreamConstants(t *testing.T) {
+	p := NewParserOptions(New("0x10 1uL 0b11 08 1'000'000 0x1'Fu"), Options{Std: C23})
+	s, err := p.Stream()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		ttype  uint
+		value  uint64
+		suffix string
+	}{
+		{lex.INT_CONST, 16, ""},
+		{lex.INT_CONST, 1, "uL"},
+		{lex.INT_CONST, 3, ""},
+		{lex.ERR, 0, ""},
+		{lex.INT_CONST, 1000000, ""},
+		{lex.INT_CONST, 31, "u"},
+	}
+	for i, test := range tt {
+		tok := s.Lex()
+		if tok.Type != test.ttype || tok.Value != test.value || tok.Suffix != test.suffix {
+			t.Errorf("expected %s %d%s at tt[%d], got %s %d%s", lex.Tmap[test.ttype],
+				test.value, test.suffix, i, lex.Tmap[tok.Type], tok.Value, tok.Suffix)
+		}
+	}
+}
+
+func TestStreamStrings(t *testing.T) {
+	p := NewParser(New("#define S \"b\\\"\"\n\"a\" S\nL\"c\"; \"d\""))
+	s, err := p.Stream()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+
+	// literals coming from different lines and macros are adjacent as well
+	tt := []struct {
+		ttype   uint
+		literal string
+		prefix  string
+	}{
+		{lex.STRING, "ab\"c", "L"},
+		{lex.SCOLON, "", ""},
+		{lex.STRING, "d", ""},
+		{lex.EOF, "", ""},
+	}
+	for i, test := range tt {
+		tok := s.Lex()
+		if tok.Type != test.ttype || tok.Literal != test.literal || tok.Prefix != test.prefix {
+			t.Errorf("expected %s %s%q at tt[%d], got %s %s%q", lex.Tmap[test.ttype],
+				test.prefix, test.literal, i, lex.Tmap[tok.Type], tok.Prefix, tok.Literal)
+		}
+	}
+}
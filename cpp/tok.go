@@ -7,11 +7,13 @@ const (
 	DEFINE
 	ELIF
 	ELSE
+	ENDIF
 	ERROR
 	IF
 	IFDEF
 	IFNDEF
 	INCLUDE
+	INCLUDE_NEXT
 	LINE
 	PRAGMA
 	UNDEF
@@ -23,6 +25,7 @@ const (
 	STRING
 	// pp misc
 	HASH
+	HASHHASH
 	NEWLINE
 	WS
 	// significant punctuators
@@ -32,9 +35,60 @@ const (
 	MACRO_BEGIN
 	// rest of C punctuators
 	PUNCT
+	// a character that can not begin any of the above, like @ or $
+	OTHER
 )
 
 type Token struct {
 	Type    uint
 	Literal string
+	// names of the macros whose replacement produced the token, none of
+	// them may replace it again
+	Hide Hideset
+	// where the token begins in the source it was lexed from
+	Pos Pos
+}
+
+// a position in the source as written, before any translation phase; the
+// line and column count from 1, columns in characters
+type Pos struct {
+	Offset int
+	Line   int
+	Col    int
+}
+
+// a hide set is never modified once attached to a token, operations
+// return a new set instead
+type Hideset map[string]bool
+
+func (h Hideset) Has(name string) bool {
+	return h[name]
+}
+func (h Hideset) add(name string) Hideset {
+	return h.union(Hideset{name: true})
+}
+func (h Hideset) union(o Hideset) Hideset {
+	if len(o) == 0 {
+		return h
+	} else if len(h) == 0 {
+		return o
+	}
+
+	u := Hideset{}
+	for name := range h {
+		u[name] = true
+	}
+	for name := range o {
+		u[name] = true
+	}
+	return u
+}
+func (h Hideset) intersect(o Hideset) Hideset {
+	i := Hideset{}
+	for name := range h {
+		if o[name] {
+			i[name] = true
+		}
+	}
+	return i
 }
@@ -0,0 +1,239 @@
+package cpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// records every macro invocation while set in Options; the zero value is
+// ready to use
+type Tracer struct {
+	// the invocations not nested in any other, in the order they happened
+	Expansions []*Expansion
+
+	byID map[string]*Expansion
+	seq  int
+	// invocations whose arguments are being expanded, and the number of
+	// nested expansions of argument and directive operands
+	args  []*Expansion
+	depth int
+}
+
+// one macro invocation
+type Expansion struct {
+	Macro string
+	// the arguments as written, nil for object-like macros
+	Args [][]Token
+	// the replacement list after substitution, and the tokens that came
+	// out of it once rescanned
+	Replacement []Token
+	Result      []Token
+	Use         Location
+	Def         Location
+	// invocations found in the arguments or during the rescan
+	Nested []*Expansion
+
+	// added to the hide set of the replacement, so that the invocations
+	// and the result it leads to can be told apart
+	id    string
+	seq   int
+	depth int
+}
+
+// a place in the source as reported, with #line applied; the column is 0
+// when not known
+type Location struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (l Location) String() string {
+	parts := []string{}
+	if l.File != "" {
+		parts = append(parts, l.File)
+	}
+	if l.Line > 0 {
+		parts = append(parts, strconv.Itoa(l.Line))
+	}
+	if l.Col > 0 {
+		parts = append(parts, strconv.Itoa(l.Col))
+	}
+	return strings.Join(parts, ":")
+}
+
+// starts tracing the invocation of m by tok, nil without a tracer
+func (p *Parser) invoke(m *macro, tok Token, args [][]Token) *Expansion {
+	t := p.opts.Tracer
+	if t == nil {
+		return nil
+	}
+	if t.byID == nil {
+		t.byID = map[string]*Expansion{}
+	}
+
+	t.seq++
+	e := &Expansion{
+		Macro: m.name,
+		Args:  args,
+		Use:   Location{File: p.presumed, Line: p.where},
+		Def:   m.def,
+		id:    "#" + strconv.Itoa(t.seq),
+		seq:   t.seq,
+		depth: t.depth,
+	}
+	// only tokens read from the file know where they were written
+	if len(tok.Hide) == 0 && tok.Pos.Line > 0 {
+		e.Use.Line, e.Use.Col = tok.Pos.Line+p.delta, tok.Pos.Col
+	}
+
+	// the invocation is nested in the latest one whose arguments are
+	// being expanded or whose replacement it comes from
+	var parent *Expansion
+	if len(t.args) > 0 {
+		parent = t.args[len(t.args)-1]
+	}
+	for name := range tok.Hide {
+		if up, ok := t.byID[name]; ok && (parent == nil || parent.seq < up.seq) {
+			parent = up
+		}
+	}
+	if parent != nil {
+		parent.Nested = append(parent.Nested, e)
+	} else {
+		t.Expansions = append(t.Expansions, e)
+	}
+
+	t.byID[e.id] = e
+	t.args = append(t.args, e)
+	return e
+}
+
+// the replacement of e is done, its tokens are marked so that the result
+// of the rescan is found
+func (p *Parser) replaced(e *Expansion, body []Token) []Token {
+	if e == nil {
+		return body
+	}
+	t := p.opts.Tracer
+	t.args = t.args[:len(t.args)-1]
+
+	out := make([]Token, len(body))
+	for i, tok := range body {
+		tok.Hide = tok.Hide.add(e.id)
+		out[i] = tok
+	}
+	e.Replacement = out
+
+	return out
+}
+
+// appends the tokens an expansion is done with to out, each belongs to the
+// result of every invocation it came from at the current depth
+func (p *Parser) emit(out []Token, toks ...Token) []Token {
+	if t := p.opts.Tracer; t != nil {
+		for _, tok := range toks {
+			for name := range tok.Hide {
+				if e, ok := t.byID[name]; ok && e.depth == t.depth {
+					e.Result = append(e.Result, tok)
+				}
+			}
+		}
+	}
+	return append(out, toks...)
+}
+
+// writes the invocations as an indented tree, one invocation per line
+// followed by its replacement and result
+func (t *Tracer) WriteTree(w io.Writer) error {
+	var out bytes.Buffer
+	for _, e := range t.Expansions {
+		e.tree(&out, "")
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func (e *Expansion) tree(out *bytes.Buffer, indent string) {
+	fmt.Fprintf(out, "%s%s at %s, defined at %s\n", indent, e.invocation(), e.Use, e.Def)
+	fmt.Fprintf(out, "%s  -> %s\n", indent, spell(e.Replacement))
+	fmt.Fprintf(out, "%s  => %s\n", indent, spell(e.Result))
+	for _, n := range e.Nested {
+		n.tree(out, indent+"    ")
+	}
+}
+
+// the name of the macro followed by its arguments
+func (e *Expansion) invocation() string {
+	if e.Args == nil {
+		return e.Macro
+	}
+	args := []string{}
+	for _, arg := range e.Args {
+		args = append(args, spell(arg))
+	}
+	return e.Macro + "(" + strings.Join(args, ", ") + ")"
+}
+
+type jsonLocation struct {
+	File string `json:"file"`
+	Line int    `json:"line,omitempty"`
+	Col  int    `json:"col,omitempty"`
+}
+
+// tokens are written as they are spelled
+func (e *Expansion) MarshalJSON() ([]byte, error) {
+	var args *[]string
+	if e.Args != nil {
+		spelled := []string{}
+		for _, arg := range e.Args {
+			spelled = append(spelled, spell(arg))
+		}
+		args = &spelled
+	}
+	nested := e.Nested
+	if nested == nil {
+		nested = []*Expansion{}
+	}
+
+	return json.Marshal(struct {
+		Macro       string       `json:"macro"`
+		Args        *[]string    `json:"args,omitempty"`
+		Replacement string       `json:"replacement"`
+		Result      string       `json:"result"`
+		Use         jsonLocation `json:"use"`
+		Def         jsonLocation `json:"definition"`
+		Nested      []*Expansion `json:"nested"`
+	}{
+		Macro:       e.Macro,
+		Args:        args,
+		Replacement: spell(e.Replacement),
+		Result:      spell(e.Result),
+		Use:         jsonLocation(e.Use),
+		Def:         jsonLocation(e.Def),
+		Nested:      nested,
+	})
+}
+
+// writes the invocations as a JSON array
+func (t *Tracer) WriteJSON(w io.Writer) error {
+	expansions := t.Expansions
+	if expansions == nil {
+		expansions = []*Expansion{}
+	}
+	b, err := json.MarshalIndent(expansions, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// the spelling of toks with surrounding whitespace removed
+func spell(toks []Token) string {
+	return join(trimWS(toks))
+}
@@ -0,0 +1,109 @@
+package cpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	src := "#define SQ(x) ((x) * (x))\n#define A 1 + B\n#define B 2\nint y = SQ(A) + __LINE__;\n"
+	tracer := &Tracer{}
+	p := NewParserOptions(New(src), Options{Filename: "main.c", Tracer: tracer})
+	check(t, p, "\n\n\nint y = ((1 + 2) * (1 + 2)) + 4;\n")
+
+	var tree bytes.Buffer
+	tracer.WriteTree(&tree)
+	want := `SQ(A) at main.c:4:9, defined at main.c:1:9
+  -> ((1 + 2) * (1 + 2))
+  => ((1 + 2) * (1 + 2))
+    A at main.c:4:12, defined at main.c:2:9
+      -> 1 + B
+      => 1 + 2
+        B at main.c:4, defined at main.c:3:9
+          -> 2
+          => 2
+__LINE__ at main.c:4:17, defined at <built-in>
+  -> 4
+  => 4
+`
+	if tree.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, tree.String())
+	}
+
+	var out bytes.Buffer
+	if err := tracer.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]any
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0]["macro"] != "SQ" || decoded[1]["args"] != nil {
+		t.Errorf("unexpected JSON %s", out.String())
+	}
+	sq := decoded[0]
+	if args, _ := sq["args"].([]any); len(args) != 1 || args[0] != "A" {
+		t.Errorf("expected the argument A, got %v", sq["args"])
+	}
+	if use, _ := sq["use"].(map[string]any); use["file"] != "main.c" || use["line"] != 4.0 {
+		t.Errorf("unexpected location of use %v", sq["use"])
+	}
+}
+
+func TestTracerNesting(t *testing.T) {
+	tt := []struct {
+		src  string
+		tree string
+	}{
+		// the rescan finds g in the replacement of f
+		{"#define f(x) g(x)\n#define g(x) x\nf(1)\n", `f(1) at 3:1, defined at 1:9
+  -> g(1)
+  => 1
+    g(1) at 3, defined at 2:9
+      -> 1
+      => 1
+`},
+		// invocations one after the other are not nested
+		{"#define A a\nA A\n", `A at 2:1, defined at 1:9
+  -> a
+  => a
+A at 2:3, defined at 1:9
+  -> a
+  => a
+`},
+		// the operand of # is not expanded, the argument is not used
+		{"#define s(x) #x\n#define n(x)\n#define A a\ns(A) n(A)\n", `s(A) at 4:1, defined at 1:9
+  -> "A"
+  => "A"
+n(A) at 4:6, defined at 2:9
+  -> 
+  => 
+`},
+		{"#define E\n#define f() E\n#if f()\n#endif\n", `f() at 3:5, defined at 2:9
+  -> E
+  => 
+    E at 3, defined at 1:9
+      -> 
+      => 
+`},
+	}
+
+	for _, test := range tt {
+		tracer := &Tracer{}
+		p := NewParserOptions(New(test.src), Options{Tracer: tracer})
+		p.Expand()
+
+		var tree bytes.Buffer
+		tracer.WriteTree(&tree)
+		if tree.String() != test.tree {
+			t.Errorf("expected\n%s\ngot\n%s", test.tree, tree.String())
+		}
+	}
+
+	var out bytes.Buffer
+	(&Tracer{}).WriteJSON(&out)
+	if out.String() != "[]\n" {
+		t.Errorf("expected an empty array, got %s", out.String())
+	}
+}
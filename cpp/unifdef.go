@@ -0,0 +1,553 @@
+package cpp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// what the caller told about a symbol, a defined symbol whose value is not
+// a constant expression is known to be defined, but its value is not
+type symbol struct {
+	defined bool
+	known   bool
+	v       value
+}
+
+// one if-section being partially preprocessed
+type section struct {
+	line int
+	// a directive of the section was kept, so the ones after it are kept
+	// as well
+	emitted bool
+	// a group known to be included was found, the groups after it are
+	// dropped
+	done bool
+	// the lines of the current group are kept
+	keep bool
+	// the section is inside of a dropped group
+	dead    bool
+	sawElse bool
+}
+
+// partial preprocessing, like the unifdef tool: conditionals are resolved
+// as far as the symbols of defs, which are defined or undefined like on the
+// command line, tell. Groups known to be excluded are removed along with the
+// directives of the sections whose outcome is known, expressions depending
+// on other symbols are simplified, and everything else, comments and
+// conditions mentioning none of the symbols included, is written out
+// unchanged.
+func Unifdef(src string, defs []MacroDef) (string, []error) {
+	u := &unifdef{src: src, syms: map[string]symbol{}, p: NewParser(New(""))}
+
+	for _, def := range defs {
+		name, value, ok := strings.Cut(def.Text, "=")
+		if def.Undef {
+			u.syms[def.Text] = symbol{known: true}
+			continue
+		}
+		if !ok {
+			value = "1"
+		}
+		s := symbol{defined: true}
+		if v := u.simplify(tokenize(value)); v.known {
+			s.known, s.v = true, v.v
+		}
+		u.syms[name] = s
+	}
+
+	l := New(src)
+	start := 0
+	for {
+		line := []Token{}
+		tok := l.Lex()
+		for tok.Type != NEWLINE && tok.Type != EOF {
+			line = append(line, tok)
+			tok = l.Lex()
+		}
+
+		end := len(src)
+		if tok.Type == NEWLINE {
+			end = tok.Pos.Offset + 1
+		}
+		if start < end {
+			u.line(line, start, end)
+		}
+		if tok.Type == EOF {
+			break
+		}
+		start = end
+	}
+
+	for _, s := range u.sections {
+		u.error(s.line, "unterminated conditional directive")
+	}
+
+	if len(u.err) != 0 {
+		return "", u.err
+	}
+	return u.out.String(), nil
+}
+
+type unifdef struct {
+	src      string
+	syms     map[string]symbol
+	sections []section
+	out      bytes.Buffer
+	err      []error
+	// folds constants, an error it reports makes an expression unknown
+	p *Parser
+	// the expression simplified last mentions a symbol of the caller
+	used bool
+}
+
+// handles the logical line src[start:end], made of toks
+func (u *unifdef) line(toks []Token, start, end int) {
+	text := u.src[start:end]
+
+	i := nextSignificant(toks, 0)
+	if i >= len(toks) || toks[i].Type != HASH {
+		if u.keeping() {
+			u.out.WriteString(text)
+		}
+		return
+	}
+	j := nextSignificant(toks, i+1)
+	if j >= len(toks) {
+		if u.keeping() {
+			u.out.WriteString(text)
+		}
+		return
+	}
+	kw := toks[j]
+	expr := toks[j+1:]
+	lineno := toks[i].Pos.Line
+
+	switch kw.Type {
+	case IF, IFDEF, IFNDEF:
+		if !u.keeping() {
+			u.sections = append(u.sections, section{line: lineno, dead: true})
+			return
+		}
+		s := section{line: lineno}
+		v, rewritten := u.condition(kw.Type, expr)
+		switch {
+		case !v.known:
+			s.keep, s.emitted = true, true
+			u.write(start, text, kw, "", rewritten)
+		case v.v.n != 0:
+			s.keep, s.done = true, true
+		}
+		u.sections = append(u.sections, s)
+	case ELIF:
+		s := u.top(lineno, "#elif")
+		if s == nil || s.dead {
+			return
+		} else if s.sawElse {
+			u.error(lineno, "#elif after #else")
+			return
+		} else if s.done {
+			s.keep = false
+			return
+		}
+
+		v, rewritten := u.condition(ELIF, expr)
+		switch {
+		case !v.known && !s.emitted:
+			// the groups before were all dropped
+			s.keep, s.emitted = true, true
+			u.write(start, text, kw, "if", rewritten)
+		case !v.known:
+			s.keep = true
+			u.write(start, text, kw, "", rewritten)
+		case v.v.n != 0 && s.emitted:
+			s.keep, s.done = true, true
+			u.out.WriteString(u.src[start:kw.Pos.Offset] + "else\n")
+		case v.v.n != 0:
+			s.keep, s.done = true, true
+		default:
+			s.keep = false
+		}
+	case ELSE:
+		s := u.top(lineno, "#else")
+		if s == nil || s.dead {
+			return
+		} else if s.sawElse {
+			u.error(lineno, "#else after #else")
+			return
+		}
+		s.sawElse = true
+
+		switch {
+		case s.done:
+			s.keep = false
+		case s.emitted:
+			s.keep = true
+			u.out.WriteString(text)
+		default:
+			s.keep, s.done = true, true
+		}
+	case ENDIF:
+		s := u.top(lineno, "#endif")
+		if s == nil {
+			return
+		}
+		u.sections = u.sections[:len(u.sections)-1]
+		if !s.dead && s.emitted {
+			u.out.WriteString(text)
+		}
+	default:
+		if u.keeping() {
+			u.out.WriteString(text)
+		}
+	}
+}
+
+// the lines of the current group are kept when no enclosing group is
+// dropped
+func (u *unifdef) keeping() bool {
+	for _, s := range u.sections {
+		if !s.keep {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *unifdef) top(line int, directive string) *section {
+	if len(u.sections) == 0 {
+		u.error(line, "%s without #if", directive)
+		return nil
+	}
+	return &u.sections[len(u.sections)-1]
+}
+
+// writes the kept directive text, which starts at offset start, with its
+// keyword replaced when keyword is set and its expression when expr is
+func (u *unifdef) write(start int, text string, kw Token, keyword, expr string) {
+	if keyword == "" && expr == "" {
+		u.out.WriteString(text)
+		return
+	}
+
+	head := u.src[start:kw.Pos.Offset]
+	if keyword == "" {
+		keyword = kw.Literal
+	}
+	if expr == "" {
+		u.out.WriteString(head + keyword + text[kw.Pos.Offset+len(kw.Literal)-start:])
+		return
+	}
+	u.out.WriteString(head + keyword + " " + expr + "\n")
+}
+
+// the value of the condition, or the spelling of its simplified form
+// when it could be simplified but not resolved
+func (u *unifdef) condition(ttype uint, toks []Token) (partial, string) {
+	sig := significant(toks)
+
+	if ttype == IFDEF || ttype == IFNDEF {
+		if len(sig) != 1 || !isIdent(sig[0]) {
+			return partial{}, ""
+		}
+		s, ok := u.syms[sig[0].Literal]
+		if !ok {
+			return partial{}, ""
+		}
+		return partial{known: true, v: boolean(s.defined == (ttype == IFDEF))}, ""
+	}
+
+	// like the unifdef tool, conditions on nothing but constants are left
+	// for the compiler
+	v := u.simplify(sig)
+	if !u.used {
+		return partial{}, ""
+	}
+	if v.known || !v.changed {
+		return v, ""
+	}
+	return v, v.text
+}
+
+// what is known about a (sub)expression: its value, or the spelling it
+// simplifies to
+type partial struct {
+	known bool
+	v     value
+	text  string
+	// the expression differs from how it was written
+	changed bool
+	// only the truth value is right, as for an operand of && or || that
+	// the other operand decided
+	truth bool
+	// text is enclosed in parentheses
+	paren bool
+}
+
+type simplifier struct {
+	u    *unifdef
+	e    *evaluator
+	toks []Token
+	pos  int
+}
+
+// resolves toks as far as the known symbols allow, an expression that can
+// not be parsed is left as it is
+func (u *unifdef) simplify(toks []Token) partial {
+	toks = significant(toks)
+	u.p.err, u.used = nil, false
+	s := &simplifier{u: u, e: &evaluator{p: u.p, toks: toks}, toks: toks}
+
+	if len(toks) == 0 {
+		return partial{}
+	}
+	v := s.expr(lowest)
+	if s.e.failed || s.pos < len(toks) {
+		return partial{text: join(toks)}
+	}
+	return v
+}
+
+func (s *simplifier) expr(currPrec uint) partial {
+	left := s.unary()
+
+	for !s.e.failed && currPrec < s.prec() {
+		op := s.curr().Literal
+		opPrec := s.prec()
+		s.pos++
+
+		switch op {
+		case "&&", "||":
+			right := s.expr(opPrec)
+			left = logical(op, left, right)
+		case "?":
+			then := s.expr(lowest)
+			if s.e.failed || s.pos >= len(s.toks) || s.curr().Literal != ":" {
+				s.e.failed = true
+				return partial{}
+			}
+			s.pos++
+			els := s.expr(opPrec - 1)
+
+			if left.known && left.v.n != 0 {
+				left = then
+				left.changed = true
+			} else if left.known {
+				left = els
+				left.changed = true
+			} else {
+				left = partial{
+					text: left.text + " ? " + then.operand() + " : " +
+						els.operand(),
+					changed: left.changed || then.changed || els.changed,
+				}
+			}
+		default:
+			right := s.expr(opPrec)
+			if left.known && right.known {
+				left = partial{
+					known:   true,
+					v:       s.e.binary(op, left.v, right.v, true),
+					changed: true,
+				}
+			} else {
+				left = partial{
+					text:    left.operand() + " " + op + " " + right.operand(),
+					changed: left.changed || right.changed,
+				}
+			}
+		}
+	}
+
+	return left
+}
+
+func (s *simplifier) unary() partial {
+	if s.e.failed || s.pos >= len(s.toks) {
+		s.e.failed = true
+		return partial{}
+	}
+	tok := s.curr()
+	s.pos++
+
+	switch tok.Type {
+	case PPNUM:
+		return partial{known: true, v: s.e.integer(tok.Literal), text: tok.Literal}
+	case CHAR_CONST:
+		return partial{known: true, v: s.e.char(tok.Literal), text: tok.Literal}
+	case PUNCT:
+		switch tok.Literal {
+		case "(":
+			v := s.expr(lowest)
+			if s.e.failed || s.pos >= len(s.toks) || s.curr().Type != RPAREN {
+				s.e.failed = true
+				return partial{}
+			}
+			s.pos++
+			if !v.known {
+				v.text, v.paren = "("+v.text+")", true
+			}
+			return v
+		case "+", "-", "~", "!":
+			v := s.unary()
+			if !v.known {
+				if tok.Literal == "!" {
+					v.truth = false
+					return partial{text: "!" + v.text, changed: v.changed}
+				}
+				return partial{text: tok.Literal + v.operand(), changed: v.changed}
+			}
+			switch tok.Literal {
+			case "-":
+				v.v.n = -v.v.n
+			case "~":
+				v.v.n = ^v.v.n
+			case "!":
+				v.v = boolean(v.v.n == 0)
+			}
+			v.text = tok.Literal + v.text
+			return v
+		}
+	default:
+		if !isIdent(tok) {
+			break
+		}
+		if tok.Literal == "defined" {
+			return s.defined()
+		}
+		if s.pos < len(s.toks) && s.curr().Literal == "(" {
+			return s.call(tok)
+		}
+
+		sym, ok := s.u.syms[tok.Literal]
+		s.u.used = s.u.used || ok
+		switch {
+		case ok && sym.known && sym.defined:
+			return partial{known: true, v: sym.v, changed: true}
+		case ok && !sym.defined:
+			return partial{known: true, v: value{}, changed: true}
+		}
+		return partial{text: tok.Literal}
+	}
+
+	s.e.failed = true
+	return partial{}
+}
+
+// defined X and defined ( X )
+func (s *simplifier) defined() partial {
+	paren := s.pos < len(s.toks) && s.curr().Literal == "("
+	if paren {
+		s.pos++
+	}
+	if s.pos >= len(s.toks) || !isIdent(s.curr()) {
+		s.e.failed = true
+		return partial{}
+	}
+	name := s.curr().Literal
+	s.pos++
+	if paren {
+		if s.pos >= len(s.toks) || s.curr().Type != RPAREN {
+			s.e.failed = true
+			return partial{}
+		}
+		s.pos++
+	}
+
+	if sym, ok := s.u.syms[name]; ok {
+		s.u.used = true
+		return partial{known: true, v: boolean(sym.defined), changed: true}
+	}
+	if paren {
+		return partial{text: "defined(" + name + ")"}
+	}
+	return partial{text: "defined " + name}
+}
+
+// an invocation of a function-like macro the caller did not tell about
+func (s *simplifier) call(name Token) partial {
+	text := name.Literal
+	depth := 0
+
+	for s.pos < len(s.toks) {
+		tok := s.curr()
+		s.pos++
+
+		switch {
+		case tok.Literal == "(":
+			depth++
+		case tok.Type == RPAREN:
+			depth--
+		}
+		if tok.Type == COMMA {
+			text += ", "
+		} else {
+			text += tok.Literal
+		}
+		if depth == 0 {
+			return partial{text: text}
+		}
+	}
+
+	s.e.failed = true
+	return partial{}
+}
+
+// && and || are decided by a known operand, or reduced to the other one
+func logical(op string, l, r partial) partial {
+	and := op == "&&"
+
+	switch {
+	case l.known && r.known:
+		if and {
+			return partial{known: true, v: boolean(l.v.n != 0 && r.v.n != 0), changed: true}
+		}
+		return partial{known: true, v: boolean(l.v.n != 0 || r.v.n != 0), changed: true}
+	case l.known || r.known:
+		known, other := l, r
+		if r.known {
+			known, other = r, l
+		}
+		// 0 && x is 0 and 1 || x is 1, otherwise the other decides
+		if (known.v.n != 0) != and {
+			return partial{known: true, v: boolean(!and), changed: true}
+		}
+		other.changed, other.truth = true, true
+		return other
+	}
+
+	return partial{
+		text:    l.text + " " + op + " " + r.text,
+		changed: l.changed || r.changed,
+	}
+}
+
+// the spelling of p as the operand of an operator other than && and ||
+func (p partial) operand() string {
+	switch {
+	case p.known && p.v.unsigned:
+		return strconv.FormatUint(uint64(p.v.n), 10) + "u"
+	case p.known && p.changed:
+		return strconv.FormatInt(p.v.n, 10)
+	case p.known:
+		return p.text
+	case p.truth && p.paren:
+		return "!!" + p.text
+	case p.truth:
+		return "!!(" + p.text + ")"
+	}
+	return p.text
+}
+
+func (s *simplifier) prec() uint {
+	s.e.pos = s.pos
+	return s.e.prec()
+}
+func (s *simplifier) curr() Token {
+	return s.toks[s.pos]
+}
+func (u *unifdef) error(line int, format string, rest ...any) {
+	msg := fmt.Sprintf(format, rest...)
+	u.err = append(u.err, fmt.Errorf("line %d: %s", line, msg))
+}
@@ -0,0 +1,66 @@
+package cpp
+
+import "testing"
+
+func TestUnifdef(t *testing.T) {
+	defs := []MacroDef{{Text: "A"}, {Text: "V=2"}, {Undef: true, Text: "B"}, {Text: "F=f(x)"}}
+
+	tt := []Pair{
+		// unknown symbols leave everything as it is, comments included
+		{"#ifdef X /* x */\nx\n#else\ny\n#endif\n", "#ifdef X /* x */\nx\n#else\ny\n#endif\n"},
+		{"// c\n#define Z 1 /* z */\nz\n", "// c\n#define Z 1 /* z */\nz\n"},
+		{"#if X+1 > 2\nx\n#endif", "#if X+1 > 2\nx\n#endif"},
+		// and so do constant conditions, which are left to the compiler
+		{"#if 0\nx\n#else\ny\n#endif\n", "#if 0\nx\n#else\ny\n#endif\n"},
+		{"#if 1 || X\nx\n#endif\n", "#if 1 || X\nx\n#endif\n"},
+		{"#ifdef A\n#if 1\na\n#endif\n#endif\n", "#if 1\na\n#endif\n"},
+		{"#if B\nb\n#elif 1\nx\n#endif\n", "#if 1\nx\n#endif\n"},
+		// known ones resolve the section
+		{"#ifdef A\na\n#else\nb\n#endif\nc\n", "a\nc\n"},
+		{"#ifndef A\na\n#else\nb\n#endif\n", "b\n"},
+		{"#ifdef B\na\n#endif\n", ""},
+		{"#if V == 2 && !defined(B)\na\n#endif\n", "a\n"},
+		{"#if B\na\n#elif V > 1\nb\n#else\nc\n#endif\n", "b\n"},
+		// and simplify the expressions they are part of
+		{"#if A && X\na\n#endif\n", "#if X\na\n#endif\n"},
+		{"#if defined X || defined(B)\na\n#endif\n", "#if defined X\na\n#endif\n"},
+		{"#if X || A\na\n#endif\n", "a\n"},
+		{"#if B && X\na\n#endif\n", ""},
+		{"#if V + X > 1\na\n#endif\n", "#if 2 + X > 1\na\n#endif\n"},
+		{"#if (A && X) + 1\na\n#endif\n", "#if !!(X) + 1\na\n#endif\n"},
+		{"#if (A && X + 1) * 2\na\n#endif\n", "#if !!(X + 1) * 2\na\n#endif\n"},
+		{"#if F\na\n#endif\n", "#if F\na\n#endif\n"},
+		// groups around the one picked
+		{"#if X\nx\n#elif A\na\n#else\nb\n#endif\n", "#if X\nx\n#else\na\n#endif\n"},
+		{"#if B\nb\n#elif X\nx\n#else\ny\n#endif\n", "#if X\nx\n#else\ny\n#endif\n"},
+		{"#if B\nb\n#elif X // x\nx\n#endif\n", "#if X // x\nx\n#endif\n"},
+		{"#if X\nx\n#elif B\nb\n#elif Y\ny\n#endif\n", "#if X\nx\n#elif Y\ny\n#endif\n"},
+		// nested sections
+		{"#ifdef X\n#ifdef A\na\n#endif\n#endif\n", "#ifdef X\na\n#endif\n"},
+		{"#ifdef B\n#ifdef X\nx\n#else\n#endif\n#endif\n", ""},
+		// a line spliced directive
+		{"#if A && \\\n X\nx\n#endif\n", "#if X\nx\n#endif\n"},
+	}
+
+	for _, test := range tt {
+		out, err := Unifdef(test.input, defs)
+		if len(err) != 0 {
+			t.Errorf("%q: %v", test.input, err)
+		} else if out != test.output {
+			t.Errorf("%q: expected %q, got %q", test.input, test.output, out)
+		}
+	}
+
+	errs := []string{
+		"#endif\n",
+		"#else\n",
+		"#if X\n",
+		"#if X\n#else\n#else\n#endif\n",
+		"#if X\n#else\n#elif Y\n#endif\n",
+	}
+	for _, input := range errs {
+		if _, err := Unifdef(input, defs); len(err) == 0 {
+			t.Errorf("no error reported for %q", input)
+		}
+	}
+}
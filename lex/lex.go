@@ -1,8 +1,13 @@
 package lex
 
 import (
+	"bytes"
 	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf16"
 )
 
 var Tmap = map[uint]string{
@@ -128,17 +133,113 @@ var kw_map = map[string]uint{
 	"while":    WHILE,
 }
 
+// operators and punctuators by spelling
+var op_map = map[string]uint{}
+
+func init() {
+	for ttype := uint(LBRACKET); ttype <= ELLIP; ttype++ {
+		op_map[Tmap[ttype]] = ttype
+	}
+	for digraph, ttype := range digraphs {
+		op_map[digraph] = ttype
+	}
+}
+
+// alternative spellings of punctuators, %: and %:%: only mean something
+// to the preprocessor
+var digraphs = map[string]uint{
+	"<:": LBRACKET,
+	":>": RBRACKET,
+	"<%": LBRACE,
+	"%>": RBRACE,
+}
+
+// the keyword spelled by ident, IDENT when it is none
+func Lookup(ident string) uint {
+	if kword, ok := kw_map[ident]; ok {
+		return kword
+	}
+	return IDENT
+}
+
+// the operator or punctuator spelled by s, ERR when it is none
+func Punctuator(s string) uint {
+	if ttype, ok := op_map[s]; ok {
+		return ttype
+	}
+	return ERR
+}
+
+// anything tokens are read from, like a Lexer or the output of the
+// preprocessor; EOF is returned once the tokens are exhausted
+type Source interface {
+	Lex() Token
+}
+
 type Lexer struct {
 	src   []rune
 	sp    int
 	kword map[string]uint
+	opts  Options
+	// the position in the original source, which linemarkers may change;
+	// bol is set while only whitespace has been seen on the line
+	line  uint
+	file  string
+	bol   bool
+	start uint
+	// the byte offset of every character and of the end, the index of the
+	// first character of the line and of the token being lexed
+	off   []int
+	first int
+	begin int
+}
+
+type Options struct {
+	// binary constants like 0b101 and ' as digit separator, as in 1'000
+	C23 bool
 }
 
 func New(src string) *Lexer {
-	l := &Lexer{src: []rune(src), kword: kw_map}
+	return NewOptions(src, Options{})
+}
+
+func NewOptions(src string, opts Options) *Lexer {
+	l := &Lexer{src: []rune(src), kword: kw_map, opts: opts, line: 1, bol: true}
+
+	l.off = make([]int, 0, len(l.src)+1)
+	for i := range src {
+		l.off = append(l.off, i)
+	}
+	l.off = append(l.off, len(src))
+
 	return l
 }
+
+// the next token, with the line, column and file it begins in, and where
+// it ends
 func (l *Lexer) Lex() Token {
+	tok := l.lex()
+	tok.Start = Pos{
+		Offset: l.off[l.begin],
+		Line:   l.start,
+		Col:    uint(l.begin - l.first + 1),
+		File:   l.file,
+	}
+	tok.End = l.position()
+	tok.Line, tok.Col, tok.File = tok.Start.Line, tok.Start.Col, l.file
+	return tok
+}
+
+// the position of the next character
+func (l *Lexer) position() Pos {
+	return Pos{
+		Offset: l.off[l.sp],
+		Line:   l.line,
+		Col:    uint(l.sp - l.first + 1),
+		File:   l.file,
+	}
+}
+func (l *Lexer) lex() Token {
 	for !l.isend() {
 		c := l.peek()
 
@@ -146,6 +247,12 @@ func (l *Lexer) Lex() Token {
 			l.adv()
 			continue
 		}
+		if c == '#' && l.bol && l.marker() {
+			continue
+		}
+		l.bol = false
+		l.start, l.begin = l.line, l.sp
+
 		if unicode.IsLetter(c) {
 			return l.word()
 		}
@@ -163,7 +270,9 @@ func (l *Lexer) Lex() Token {
 			return tok(SCOLON)
 		case ':':
 			l.adv()
-			return tok(COLON)
+			ttype = l.match(">", RBRACKET, ttype)
+			ttype = l.match("", COLON, ttype)
+			return tok(ttype)
 		case '{':
 			l.adv()
 			return tok(LBRACE)
@@ -189,6 +298,9 @@ func (l *Lexer) Lex() Token {
 			l.adv()
 			return tok(BCOMP)
 		case '.':
+			if l.sp+1 < len(l.src) && unicode.IsDigit(l.src[l.sp+1]) {
+				return l.number()
+			}
 			l.adv()
 			ttype = l.match("..", ELLIP, ttype)
 			ttype = l.match("", DOT, ttype)
@@ -213,7 +325,16 @@ func (l *Lexer) Lex() Token {
 			return tok(ttype)
 		case '%':
 			l.adv()
+			// %: and %:%: are left to the preprocessor
+			if start := l.sp - 1; l.match(":", ERR, EOF) == ERR {
+				l.match("%:", ERR, EOF)
+				return Token{
+					Type:    ERR,
+					Literal: fmt.Sprintf("stray '%s' in program", string(l.src[start:l.sp])),
+				}
+			}
 			ttype = l.match("=", MOD_ASSIGN, ttype)
+			ttype = l.match(">", RBRACE, ttype)
 			ttype = l.match("", MOD, ttype)
 			return tok(ttype)
 		case '/':
@@ -226,6 +347,8 @@ func (l *Lexer) Lex() Token {
 			ttype = l.match("<=", LS_ASSIGN, ttype)
 			ttype = l.match("<", LSHIFT, ttype)
 			ttype = l.match("=", LEQ, ttype)
+			ttype = l.match(":", LBRACKET, ttype)
+			ttype = l.match("%", LBRACE, ttype)
 			ttype = l.match("", LT, ttype)
 			return tok(ttype)
 		case '>':
@@ -265,7 +388,9 @@ func (l *Lexer) Lex() Token {
 		case '_':
 			return l.word()
 		case '"':
-			return l.string()
+			return l.string("")
+		case '\'':
+			return l.char("", l.sp)
 
 		default:
 			l.adv()
@@ -276,38 +401,369 @@ func (l *Lexer) Lex() Token {
 		}
 	}
 
+	l.start, l.begin = l.line, l.sp
 	return tok(EOF)
 }
 
-func (l *Lexer) string() Token {
-	l.adv()
+// # digit-sequence "s-char-sequence"? flags... '\n', as written by the
+// preprocessor: the next line is the given line of the named file
+func (l *Lexer) marker() bool {
 	start := l.sp
+	l.adv()
+	l.blanks()
+
+	digits := l.sp
+	for !l.isend() && unicode.IsDigit(l.peek()) {
+		l.adv()
+	}
+	if digits == l.sp {
+		l.sp = start
+		return false
+	}
+	line, err := strconv.ParseUint(string(l.src[digits:l.sp]), 10, 32)
+	if err != nil {
+		l.sp = start
+		return false
+	}
+	l.blanks()
+
+	file := l.file
+	if !l.isend() && l.peek() == '"' {
+		name := []rune{}
+		for l.adv(); !l.isend() && l.peek() != '"' && l.peek() != '\n'; l.adv() {
+			if l.peek() == '\\' && l.sp+1 < len(l.src) {
+				l.adv()
+			}
+			name = append(name, l.peek())
+		}
+		file = string(name)
+	}
+
+	// the flags are of no interest
+	for !l.isend() && l.peek() != '\n' {
+		l.adv()
+	}
+	if !l.isend() {
+		l.adv()
+	}
+
+	l.line, l.file = uint(line), file
+	return true
+}
+func (l *Lexer) blanks() {
+	for !l.isend() && (l.peek() == ' ' || l.peek() == '\t') {
+		l.adv()
+	}
+}
+
+// " s-char-sequence ", with the prefix read from start on, and the string
+// literals following it: adjacent literals are concatenated as in
+// translation phase 6, those without a prefix taking the one of the others
+func (l *Lexer) string(prefix string) Token {
+	// the opening quote of every literal, decoded once the prefix of the
+	// whole is known
+	quotes := []int{}
 
 	for {
-		if l.isend() {
-			break
-		} else if l.peek() == '"' {
+		quotes = append(quotes, l.sp)
+		if !l.skipString() {
+			return Token{Type: ERR, Literal: "missing terminating \" character"}
+		}
+
+		next, ok := l.adjacent()
+		if !ok {
 			break
-		} else {
-			l.adv()
+		}
+		if next != "" && prefix != "" && next != prefix {
+			l.skipStrings()
+			return Token{
+				Type:    ERR,
+				Literal: "unsupported non-standard concatenation of string literals",
+			}
+		} else if next != "" {
+			prefix = next
 		}
 	}
 
-	if l.isend() {
-		return Token{
-			Type:    ERR,
-			Literal: "unterminated string",
+	end := l.sp
+	units := []uint32{}
+	for _, q := range quotes {
+		l.sp = q
+		u, err := l.quoted('"', prefix)
+		if err != "" {
+			l.sp = end
+			return Token{Type: ERR, Literal: err}
 		}
+		units = append(units, u...)
 	}
 
-	end := l.sp
+	var s string
+	switch unitBits[prefix] {
+	case 8:
+		b := make([]byte, len(units))
+		for i, u := range units {
+			b[i] = byte(u)
+		}
+		s = string(b)
+	case 16:
+		u16 := make([]uint16, len(units))
+		for i, u := range units {
+			u16[i] = uint16(u)
+		}
+		s = string(utf16.Decode(u16))
+	default:
+		r := make([]rune, len(units))
+		for i, u := range units {
+			r[i] = rune(u)
+		}
+		s = string(r)
+	}
+
+	return Token{Type: STRING, Literal: s, Units: units, Prefix: prefix}
+}
+
+// moves past a string literal, false when it is not terminated on its line
+func (l *Lexer) skipString() bool {
+	for l.adv(); !l.isend() && l.peek() != '"' && l.peek() != '\n'; l.adv() {
+		if l.peek() == '\\' && l.sp+1 < len(l.src) && l.src[l.sp+1] != '\n' {
+			l.adv()
+		}
+	}
+	if l.isend() || l.peek() != '"' {
+		return false
+	}
 	l.adv()
+	return true
+}
+
+// the prefix of a string literal following the current one after
+// whitespace and linemarkers, which is then at its opening quote; nothing
+// is read when there is none
+func (l *Lexer) adjacent() (string, bool) {
+	sp, line, file, bol, first := l.sp, l.line, l.file, l.bol, l.first
+
+	for !l.isend() {
+		if unicode.IsSpace(l.peek()) {
+			l.adv()
+		} else if l.peek() != '#' || !l.bol || !l.marker() {
+			break
+		}
+	}
+	for _, prefix := range []string{"", "L", "U", "u8", "u"} {
+		if l.match(prefix+`"`, STRING, EOF) == STRING {
+			l.sp--
+			l.bol = false
+			return prefix, true
+		}
+	}
+
+	l.sp, l.line, l.file, l.bol, l.first = sp, line, file, bol, first
+	return "", false
+}
+
+// the rest of a malformed sequence of adjacent literals is part of it
+func (l *Lexer) skipStrings() {
+	for l.skipString() {
+		if _, ok := l.adjacent(); !ok {
+			return
+		}
+	}
+}
+
+// the size in bits of the elements of character constants and string
+// literals by encoding prefix, wchar_t being 32 bits wide
+var unitBits = map[string]uint{
+	"":   8,
+	"u8": 8,
+	"u":  16,
+	"U":  32,
+	"L":  32,
+}
+
+// ' c-char-sequence ', with the prefix read from start on. The value is
+// that of an int for unprefixed and L constants, with char being signed,
+// and of an unsigned type otherwise; several characters only make an int.
+func (l *Lexer) char(prefix string, start int) Token {
+	units, err := l.quoted('\'', prefix)
+	if err != "" {
+		return Token{Type: ERR, Literal: err}
+	}
+
+	var v int64
+	switch {
+	case len(units) == 0:
+		return Token{Type: ERR, Literal: "empty character constant"}
+	case prefix == "" && len(units) > 4 || prefix != "" && len(units) > 1:
+		return Token{Type: ERR, Literal: "character constant too long for its type"}
+	case prefix == "" && len(units) == 1:
+		v = int64(int8(units[0]))
+	case prefix == "":
+		var n uint32
+		for _, u := range units {
+			n = n<<8 | u
+		}
+		v = int64(int32(n))
+	case prefix == "L":
+		v = int64(int32(units[0]))
+	default:
+		v = int64(units[0])
+	}
 
 	return Token{
-		Type:    STRING,
-		Literal: string(l.src[start:end]),
+		Type:    CHAR_CONST,
+		Literal: string(l.src[start:l.sp]),
+		Value:   uint64(v),
+		Prefix:  prefix,
 	}
 }
+
+// the elements of a character constant or string literal delimited by q,
+// its escape sequences decoded and other characters encoded as told by
+// the prefix; the error is empty when well formed
+func (l *Lexer) quoted(q rune, prefix string) ([]uint32, string) {
+	bits := unitBits[prefix]
+	max := uint64(1)<<bits - 1
+	units := []uint32{}
+	l.adv()
+
+	for !l.isend() && l.peek() != q {
+		c := l.peek()
+		if c == '\n' {
+			break
+		} else if c != '\\' {
+			units = encode(units, c, bits)
+			l.adv()
+			continue
+		}
+
+		l.adv()
+		if l.isend() {
+			break
+		}
+		e := l.peek()
+		l.adv()
+
+		switch e {
+		case '\'', '"', '?', '\\':
+			units = append(units, uint32(e))
+		case 'a':
+			units = append(units, 7)
+		case 'b':
+			units = append(units, 8)
+		case 'f':
+			units = append(units, 12)
+		case 'n':
+			units = append(units, 10)
+		case 'r':
+			units = append(units, 13)
+		case 't':
+			units = append(units, 9)
+		case 'v':
+			units = append(units, 11)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := uint64(e - '0')
+			for i := 1; i < 3 && !l.isend() && '0' <= l.peek() && l.peek() <= '7'; i++ {
+				n = n*8 + uint64(l.peek()-'0')
+				l.adv()
+			}
+			if n > max {
+				l.skipQuoted(q)
+				return nil, "octal escape sequence out of range"
+			}
+			units = append(units, uint32(n))
+		case 'x':
+			start := l.sp
+			for !l.isend() && isDigit(l.peek(), 16) {
+				l.adv()
+			}
+			digits := string(l.src[start:l.sp])
+			n, err := strconv.ParseUint(digits, 16, 64)
+			if digits == "" {
+				l.skipQuoted(q)
+				return nil, "\\x used with no following hex digits"
+			} else if err != nil || n > max {
+				l.skipQuoted(q)
+				return nil, "hex escape sequence out of range"
+			}
+			units = append(units, uint32(n))
+		case 'u', 'U':
+			r, err := l.universal(e)
+			if err != "" {
+				l.skipQuoted(q)
+				return nil, err
+			}
+			units = encode(units, r, bits)
+		default:
+			l.skipQuoted(q)
+			return nil, fmt.Sprintf("unknown escape sequence '\\%c'", e)
+		}
+	}
+
+	if l.isend() || l.peek() != q {
+		return nil, fmt.Sprintf("missing terminating %c character", q)
+	}
+	l.adv()
+
+	return units, ""
+}
+
+// \u hex-quad and \U hex-quad hex-quad, naming a character outside of
+// the basic character set
+func (l *Lexer) universal(e rune) (rune, string) {
+	n := 4
+	if e == 'U' {
+		n = 8
+	}
+	start := l.sp
+	for i := 0; i < n; i++ {
+		if l.isend() || !isDigit(l.peek(), 16) {
+			return 0, fmt.Sprintf("incomplete universal character name \\%c%s",
+				e, string(l.src[start:l.sp]))
+		}
+		l.adv()
+	}
+
+	v, _ := strconv.ParseUint(string(l.src[start:l.sp]), 16, 32)
+	r := rune(v)
+	if r > unicode.MaxRune || 0xD800 <= r && r <= 0xDFFF ||
+		r < 0xA0 && r != '$' && r != '@' && r != '`' {
+		return 0, fmt.Sprintf("\\%c%s is not a valid universal character",
+			e, string(l.src[start:l.sp]))
+	}
+	return r, ""
+}
+
+// the code units of r: UTF-8 for 8 bits, UTF-16 for 16 and the character
+// itself otherwise
+func encode(units []uint32, r rune, bits uint) []uint32 {
+	switch bits {
+	case 8:
+		for _, b := range []byte(string(r)) {
+			units = append(units, uint32(b))
+		}
+	case 16:
+		for _, u := range utf16.Encode([]rune{r}) {
+			units = append(units, uint32(u))
+		}
+	default:
+		units = append(units, uint32(r))
+	}
+	return units
+}
+
+// the rest of a malformed constant or literal is part of it
+func (l *Lexer) skipQuoted(q rune) {
+	for !l.isend() && l.peek() != q && l.peek() != '\n' {
+		if l.peek() == '\\' && l.sp+1 < len(l.src) && l.src[l.sp+1] != '\n' {
+			l.adv()
+		}
+		l.adv()
+	}
+	if !l.isend() && l.peek() == q {
+		l.adv()
+	}
+}
+
 func (l *Lexer) skip_comment() {
 	if c := l.peek(); c == '/' {
 		for {
@@ -346,6 +802,17 @@ func (l *Lexer) word() Token {
 	s := string(l.src[start:end])
 	kword := l.kword[s]
 
+	// encoding prefixes
+	if !l.isend() && (l.peek() == '\'' || l.peek() == '"') {
+		switch s {
+		case "L", "u", "U", "u8":
+			if l.peek() == '"' {
+				return l.string(s)
+			}
+			return l.char(s, start)
+		}
+	}
+
 	if kword != 0 {
 		return tok(kword)
 	} else {
@@ -355,33 +822,219 @@ func (l *Lexer) word() Token {
 		}
 	}
 }
+
+// integer constants: decimal, octal with a leading 0, hexadecimal with 0x,
+// and in C23 binary with 0b; C23 also allows ' between digits. A fraction
+// or an exponent, p for hexadecimal ones, makes it a floating constant.
 func (l *Lexer) number() Token {
-	if l.peek() == '0' {
+	start := l.sp
+
+	base := 10
+	if l.peek() == '0' && l.sp+1 < len(l.src) {
+		switch l.src[l.sp+1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			if l.opts.C23 {
+				base = 2
+			}
+		}
+	}
+	if base != 10 {
 		l.adv()
-		return Token{
-			Type:    INT_CONST,
-			Literal: "0",
+		l.adv()
+	}
+
+	digits := l.digits(base)
+	var frac, exp []rune
+	float := false
+
+	if !l.isend() && l.peek() == '.' && base != 2 {
+		float = true
+		l.adv()
+		frac = l.digits(base)
+	}
+	if !l.isend() && (base == 10 && (l.peek() == 'e' || l.peek() == 'E') ||
+		base == 16 && (l.peek() == 'p' || l.peek() == 'P')) {
+		float = true
+		exp = []rune{'e'}
+		if base == 16 {
+			exp[0] = 'p'
+		}
+		l.adv()
+		if !l.isend() && (l.peek() == '+' || l.peek() == '-') {
+			exp = append(exp, l.peek())
+			l.adv()
+		}
+		if n := l.digits(10); len(n) == 0 {
+			return l.numberError("exponent has no digits")
+		} else {
+			exp = append(exp, n...)
 		}
 	}
 
-	start := l.sp
-	for {
+	suffix := l.sp
+	for !l.isend() && (isAlnum(l.peek())) {
 		l.adv()
-		if l.isend() {
-			break
-		} else if c := l.peek(); !unicode.IsDigit(c) {
-			break
+	}
+	s := string(l.src[start:l.sp])
+
+	if float {
+		return l.float(s, base, digits, frac, exp, string(l.src[suffix:l.sp]))
+	}
+
+	if len(digits) == 0 {
+		return l.numberError("invalid integer constant \"%s\"", s)
+	}
+	if base == 10 && digits[0] == '0' {
+		base = 8
+	}
+	for _, c := range digits {
+		if base == 8 && c > '7' {
+			return l.numberError("invalid digit \"%c\" in octal constant", c)
+		} else if base == 2 && c > '1' {
+			return l.numberError("invalid digit \"%c\" in binary constant", c)
 		}
 	}
-	end := l.sp
-	s := string(l.src[start:end])
+	if !intSuffix(string(l.src[suffix:l.sp])) {
+		return l.numberError("invalid suffix \"%s\" on integer constant",
+			string(l.src[suffix:l.sp]))
+	}
+
+	v, err := strconv.ParseUint(string(digits), base, 64)
+	if err != nil {
+		return l.numberError("integer constant is too large for its type")
+	}
 
 	return Token{
 		Type:    INT_CONST,
 		Literal: s,
+		Value:   v,
+		Suffix:  string(l.src[suffix:l.sp]),
 	}
 }
 
+// the largest exponent a floating constant is read with, far beyond the
+// range of any floating type
+const maxExponent = 10000
+
+// the value of a floating constant is kept exactly as written
+func (l *Lexer) float(s string, base int, digits, frac, exp []rune, suffix string) Token {
+	if len(digits) == 0 && len(frac) == 0 {
+		return l.numberError("invalid floating constant \"%s\"", s)
+	}
+	if base == 16 && len(exp) == 0 {
+		return l.numberError("hexadecimal floating constants require an exponent")
+	}
+	switch suffix {
+	case "", "f", "F", "l", "L":
+	default:
+		return l.numberError("invalid suffix \"%s\" on floating constant", suffix)
+	}
+	if len(exp) > 0 {
+		if n, err := strconv.Atoi(string(exp[1:])); err != nil || n > maxExponent || n < -maxExponent {
+			return l.numberError("floating constant exponent is out of range")
+		}
+	}
+
+	var b bytes.Buffer
+	if base == 16 {
+		b.WriteString("0x")
+	}
+	b.WriteString(string(digits))
+	if len(frac) > 0 {
+		b.WriteString("." + string(frac))
+	}
+	b.WriteString(string(exp))
+
+	v, ok := new(big.Rat).SetString(b.String())
+	if !ok {
+		return l.numberError("invalid floating constant \"%s\"", s)
+	}
+
+	return Token{
+		Type:    FLOAT_CONST,
+		Literal: s,
+		Float:   v,
+		Suffix:  suffix,
+	}
+}
+
+// the digits of base from the current character on, without separators
+func (l *Lexer) digits(base int) []rune {
+	digits := []rune{}
+	for !l.isend() {
+		c := l.peek()
+		if c == '\'' && l.opts.C23 && len(digits) > 0 &&
+			l.sp+1 < len(l.src) && isDigit(l.src[l.sp+1], base) {
+			l.adv()
+			continue
+		} else if !isDigit(c, base) {
+			break
+		}
+		digits = append(digits, c)
+		l.adv()
+	}
+	return digits
+}
+
+// lexes s as a single constant or string literal, the way the pp-numbers,
+// character constants and string literals of the preprocessor are turned
+// into tokens
+func Constant(s string, opts Options) Token {
+	l := NewOptions(s, opts)
+	tok := l.Lex()
+	if tok.Type != INT_CONST && tok.Type != FLOAT_CONST &&
+		tok.Type != CHAR_CONST && tok.Type != STRING && tok.Type != ERR {
+		return Token{Type: ERR, Literal: fmt.Sprintf("invalid constant \"%s\"", s)}
+	}
+
+	if tok.Type != ERR && !l.isend() {
+		what := "integer"
+		if tok.Type == FLOAT_CONST {
+			what = "floating"
+		}
+		return Token{
+			Type:    ERR,
+			Literal: fmt.Sprintf("invalid suffix \"%s\" on %s constant", string(l.src[l.sp:]), what),
+		}
+	}
+	return tok
+}
+
+// the rest of a malformed constant is part of it
+func (l *Lexer) numberError(format string, rest ...any) Token {
+	for !l.isend() && isAlnum(l.peek()) {
+		l.adv()
+	}
+	return Token{Type: ERR, Literal: fmt.Sprintf(format, rest...)}
+}
+
+// u, l and ll in any order and case, ll being all one case
+func intSuffix(s string) bool {
+	if strings.Contains(s, "lL") || strings.Contains(s, "Ll") {
+		return false
+	}
+	switch strings.ToLower(s) {
+	case "", "u", "l", "ul", "lu", "ll", "ull", "llu":
+		return true
+	}
+	return false
+}
+
+func isDigit(c rune, base int) bool {
+	switch base {
+	case 16:
+		return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+	default:
+		// octal and binary digits are checked once the constant is read
+		return '0' <= c && c <= '9'
+	}
+}
+func isAlnum(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+}
+
 func (l *Lexer) match(s string, ttype uint, curr uint) uint {
 	if curr != EOF {
 		return curr
@@ -406,6 +1059,11 @@ func (l *Lexer) peekn() rune {
 	return l.src[l.sp+1]
 }
 func (l *Lexer) adv() {
+	if l.src[l.sp] == '\n' {
+		l.line++
+		l.bol = true
+		l.first = l.sp + 1
+	}
 	l.sp++
 }
 func (l *Lexer) isend() bool {
@@ -1,6 +1,10 @@
 package lex
 
-import "testing"
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
 
 func TestString(t *testing.T) {
 	l := New(`"test"`)
@@ -51,10 +55,228 @@ func TestIntegers(t *testing.T) {
 	l := New(`0 1 5 100 0100`)
 	seq := []uint{
 		INT_CONST, INT_CONST, INT_CONST,
-		INT_CONST, INT_CONST, INT_CONST, EOF,
+		INT_CONST, INT_CONST, EOF,
 	}
 	tokseq(*l, seq, t)
+
+	tt := []struct {
+		input  string
+		opts   Options
+		value  uint64
+		suffix string
+	}{
+		{"0", Options{}, 0, ""},
+		{"0100", Options{}, 64, ""},
+		{"0x1F", Options{}, 31, ""},
+		{"0XabCdefu", Options{}, 0xabcdef, "u"},
+		{"10UL", Options{}, 10, "UL"},
+		{"10llu", Options{}, 10, "llu"},
+		{"10uLL", Options{}, 10, "uLL"},
+		{"18446744073709551615u", Options{}, 1<<64 - 1, "u"},
+		{"0b101", Options{C23: true}, 5, ""},
+		{"0B1'0l", Options{C23: true}, 2, "l"},
+		{"1'000'000", Options{C23: true}, 1000000, ""},
+	}
+	for _, test := range tt {
+		tok := NewOptions(test.input, test.opts).Lex()
+		if tok.Type != INT_CONST || tok.Value != test.value ||
+			tok.Suffix != test.suffix || tok.Literal != test.input {
+			t.Errorf("expected %d%s for %q, got %s %d%s", test.value,
+				test.suffix, test.input, Tmap[tok.Type], tok.Value, tok.Suffix)
+		}
+	}
+
+	errs := []string{
+		"08", "0b1", "0x", "0xg", "1lL", "1uu", "1lul", "1a",
+		"18446744073709551616",
+	}
+	for _, input := range errs {
+		l := New(input)
+		if tok := l.Lex(); tok.Type != ERR {
+			t.Errorf("no error reported for %q", input)
+		} else if tok := l.Lex(); tok.Type != EOF {
+			t.Errorf("%q not read as one token", input)
+		}
+	}
+	// a separator only goes between digits
+	for _, input := range []string{"0b12", "0x'ff", "0b"} {
+		if tok := NewOptions(input, Options{C23: true}).Lex(); tok.Type != ERR {
+			t.Errorf("no error reported for %q", input)
+		}
+	}
+}
+func TestFloats(t *testing.T) {
+	l := New(`3.14 1. .5 1e10 1.5E-3 0x1p3 0x1.8P+1 1.5f 2e2L 0.1l`)
+	seq := []uint{
+		FLOAT_CONST, FLOAT_CONST, FLOAT_CONST, FLOAT_CONST, FLOAT_CONST,
+		FLOAT_CONST, FLOAT_CONST, FLOAT_CONST, FLOAT_CONST, FLOAT_CONST, EOF,
+	}
+	tokseq(*l, seq, t)
+
+	tt := []struct {
+		input  string
+		opts   Options
+		value  string
+		suffix string
+	}{
+		// values are exact, not rounded to a binary fraction
+		{"0.1", Options{}, "1/10", ""},
+		{"3.14", Options{}, "157/50", ""},
+		{"1.5e3", Options{}, "1500/1", ""},
+		{"25e-2f", Options{}, "1/4", "f"},
+		{"0x1.8p3", Options{}, "12/1", ""},
+		{"0X.8p-1L", Options{}, "1/4", "L"},
+		{"09.5", Options{}, "19/2", ""},
+		{"1'000.0'5", Options{C23: true}, "20001/20", ""},
+	}
+	for _, test := range tt {
+		tok := NewOptions(test.input, test.opts).Lex()
+		if tok.Type != FLOAT_CONST || tok.Float.String() != test.value ||
+			tok.Suffix != test.suffix || tok.Literal != test.input {
+			t.Errorf("expected %s%s for %q, got %s %v%s", test.value,
+				test.suffix, test.input, Tmap[tok.Type], tok.Float, tok.Suffix)
+		}
+	}
+
+	errs := []string{"1e", "1e+", "0x1.8", "0x.p1", "1.5u", "1.5ff", "1.5lf", "1e99999"}
+	for _, input := range errs {
+		l := New(input)
+		if tok := l.Lex(); tok.Type != ERR {
+			t.Errorf("no error reported for %q", input)
+		} else if tok := l.Lex(); tok.Type != EOF {
+			t.Errorf("%q not read as one token", input)
+		}
+	}
+}
+
+func TestChars(t *testing.T) {
+	tt := []struct {
+		input  string
+		value  int64
+		prefix string
+	}{
+		{`'a'`, 'a', ""},
+		{`'\n'`, '\n', ""},
+		{`'\''`, '\'', ""},
+		{`'"'`, '"', ""},
+		{`'\"'`, '"', ""},
+		{`'\\'`, '\\', ""},
+		{`'\?'`, '?', ""},
+		{`'\a' `, 7, ""},
+		{`'\0'`, 0, ""},
+		{`'\101'`, 'A', ""},
+		{`'\1012'`, 'A'<<8 | '2', ""},
+		{`'\x41'`, 'A', ""},
+		// char is signed
+		{`'\xff'`, -1, ""},
+		{`'\377'`, -1, ""},
+		{`'ab'`, 'a'<<8 | 'b', ""},
+		{`'abcd'`, 'a'<<24 | 'b'<<16 | 'c'<<8 | 'd', ""},
+		{`'é'`, 0xc3<<8 | 0xa9, ""},
+		{`'\u00e9'`, 0xc3<<8 | 0xa9, ""},
+		{`L'é'`, 0xe9, "L"},
+		{`L'\xffffffff'`, -1, "L"},
+		{`u'\u20ac'`, 0x20ac, "u"},
+		{`u'\xffff'`, 0xffff, "u"},
+		{`U'\U0001F600'`, 0x1f600, "U"},
+		{`U'😀'`, 0x1f600, "U"},
+		{`u8'a'`, 'a', "u8"},
+		{`u8'\xff'`, 0xff, "u8"},
+	}
+	for _, test := range tt {
+		tok := New(test.input).Lex()
+		if tok.Type != CHAR_CONST || int64(tok.Value) != test.value ||
+			tok.Prefix != test.prefix || tok.Literal != strings.TrimSpace(test.input) {
+			t.Errorf("expected %s%d for %s, got %s %s%d", test.prefix, test.value,
+				test.input, Tmap[tok.Type], tok.Prefix, int64(tok.Value))
+		}
+	}
+
+	errs := []string{
+		`''`, `'a`, "'a\n'", `'abcde'`, `'\q'`, `'\x'`, `'\x100'`, `'\400'`,
+		`u'ab'`, `u8'é'`, `u'😀'`, `'\u12'`, `'\ud800'`, `'\u0041'`,
+		`'\U00110000'`, `L'\x100000000'`,
+	}
+	for _, input := range errs {
+		if tok := New(input).Lex(); tok.Type != ERR {
+			t.Errorf("no error reported for %s", input)
+		}
+	}
+
+	// the prefixes are identifiers otherwise, and a malformed constant is
+	// one token
+	seq := []uint{IDENT, IDENT, ERR, IDENT, EOF}
+	tokseq(*New(`L u8 '\q\'' x`), seq, t)
+}
+
+func TestStrings(t *testing.T) {
+	tt := []struct {
+		input  string
+		text   string
+		units  []uint32
+		prefix string
+	}{
+		{`"a\"b"`, `a"b`, []uint32{'a', '"', 'b'}, ""},
+		{`"\t\\\101\x42\u00e9"`, "\t\\ABé", []uint32{9, '\\', 'A', 'B', 0xc3, 0xa9}, ""},
+		{`"\xff"`, "\xff", []uint32{0xff}, ""},
+		{`""`, "", []uint32{}, ""},
+		{`u8"é"`, "é", []uint32{0xc3, 0xa9}, "u8"},
+		{`L"é\x100"`, "é\u0100", []uint32{0xe9, 0x100}, "L"},
+		{`u"😀"`, "😀", []uint32{0xd83d, 0xde00}, "u"},
+		{`U"\U0001F600"`, "😀", []uint32{0x1f600}, "U"},
+		// adjacent literals are one, taking the prefix of any of them
+		{`"a" "b"`, "ab", []uint32{'a', 'b'}, ""},
+		{"\"a\"\n\t\"b\" u\"c\"", "abc", []uint32{'a', 'b', 'c'}, "u"},
+		{`"\x" "41"`, "", nil, ""},
+		{`"\xff" L"b"`, "ÿb", []uint32{0xff, 'b'}, "L"},
+		{`L"a" "b" L"c"`, "abc", []uint32{'a', 'b', 'c'}, "L"},
+	}
+	for _, test := range tt {
+		tok := New(test.input).Lex()
+		if test.units == nil {
+			// each literal is decoded on its own
+			if tok.Type != ERR {
+				t.Errorf("no error reported for %s", test.input)
+			}
+			continue
+		}
+		if tok.Type != STRING || tok.Literal != test.text || tok.Prefix != test.prefix ||
+			fmt.Sprint(tok.Units) != fmt.Sprint(test.units) {
+			t.Errorf("expected %s%q %v for %s, got %s %s%q %v", test.prefix, test.text,
+				test.units, test.input, Tmap[tok.Type], tok.Prefix, tok.Literal, tok.Units)
+		}
+	}
+
+	errs := []string{
+		`"a`, "\"a\nb\"", `"\q"`, `"\x100"`, `u"a" U"b"`, `u8"a" L"b"`,
+	}
+	for _, input := range errs {
+		if tok := New(input).Lex(); tok.Type != ERR {
+			t.Errorf("no error reported for %s", input)
+		}
+	}
+
+	l := New("\"a\" \"b\"\nx \"c\";")
+	seq := []uint{STRING, IDENT, STRING, SCOLON, EOF}
+	tokseq(*l, seq, t)
+	l = New("\"a\"\n  \"b\"\nx")
+	if tok := l.Lex(); tok.End.Line != 2 || tok.End.Col != 6 {
+		t.Errorf("concatenated literal ends at %v", tok.End)
+	} else if tok := l.Lex(); tok.Line != 3 || tok.Col != 1 {
+		t.Errorf("token after a concatenated literal at %d:%d", tok.Line, tok.Col)
+	}
+
+	// linemarkers between adjacent literals are followed
+	l = New("\"a\"\n# 13 \"m.c\"\n\"b\";\n# 20 \"n.c\"\nx")
+	if tok := l.Lex(); tok.Type != STRING || tok.Literal != "ab" {
+		t.Errorf("expected \"ab\", got %s %q", Tmap[tok.Type], tok.Literal)
+	} else if tok := l.Lex(); tok.File != "m.c" || tok.Line != 13 {
+		t.Errorf("expected ; at m.c:13, got %s:%d", tok.File, tok.Line)
+	} else if tok := l.Lex(); tok.File != "n.c" || tok.Line != 20 {
+		t.Errorf("expected x at n.c:20, got %s:%d", tok.File, tok.Line)
+	}
 }
+
 func TestOperators(t *testing.T) {
 	l := New(`
 		[ ] ( ) . -> ++ -- & * + - ~ ! / % << >> < > <=
@@ -72,6 +294,19 @@ func TestOperators(t *testing.T) {
 	tokseq(*l, seq, t)
 }
 
+func TestDigraphs(t *testing.T) {
+	l := New(`<: :> <% %> a<:0:> %:%: %: <<: %>=`)
+	seq := []uint{
+		LBRACKET, RBRACKET, LBRACE, RBRACE, IDENT, LBRACKET,
+		INT_CONST, RBRACKET, ERR, ERR, LSHIFT, COLON, RBRACE, ASSIGN, EOF,
+	}
+	tokseq(*l, seq, t)
+
+	if tok := New("%:%:").Lex(); tok.Literal != "stray '%:%:' in program" {
+		t.Errorf("unexpected error %q", tok.Literal)
+	}
+}
+
 func tokseq(l Lexer, seq []uint, t *testing.T) {
 	for i, ttype := range seq {
 		tok := l.Lex()
@@ -81,3 +316,87 @@ func tokseq(l Lexer, seq []uint, t *testing.T) {
 		}
 	}
 }
+func TestLinemarkers(t *testing.T) {
+	l := New(`a
+# 10 "foo.h" 1
+b
+  c
+#  3 "dir/a \"b\".c" 2
+d # 7 "x.c"
+# 20
+e`)
+	tt := []struct {
+		literal string
+		line    uint
+		file    string
+	}{
+		{"a", 1, ""},
+		{"b", 10, "foo.h"},
+		{"c", 11, "foo.h"},
+		{"d", 3, `dir/a "b".c`},
+		// only a '#' beginning a line starts a marker
+		{"", 3, `dir/a "b".c`},
+		{"", 3, `dir/a "b".c`},
+		{"", 3, `dir/a "b".c`},
+		{"e", 20, `dir/a "b".c`},
+	}
+
+	for i, test := range tt {
+		tok := l.Lex()
+		if test.literal != "" && tok.Literal != test.literal {
+			t.Errorf("expected %s at tt[%d], got %s", test.literal, i, tok.Literal)
+		}
+		if tok.Line != test.line || tok.File != test.file {
+			t.Errorf("expected %s:%d at tt[%d], got %s:%d",
+				test.file, test.line, i, tok.File, tok.Line)
+		}
+	}
+	if tok := l.Lex(); tok.Type != EOF {
+		t.Errorf("expected EOF, got %s", Tmap[tok.Type])
+	}
+}
+
+func TestPositions(t *testing.T) {
+	l := New("a\tbc é+=\n\t\"ü\" x\n# 5 \"f.c\"\n  y")
+	tt := []struct {
+		start, end Pos
+	}{
+		{Pos{0, 1, 1, ""}, Pos{1, 1, 2, ""}},
+		// a tab is one column
+		{Pos{2, 1, 3, ""}, Pos{4, 1, 5, ""}},
+		// offsets count bytes, columns characters
+		{Pos{5, 1, 6, ""}, Pos{7, 1, 7, ""}},
+		{Pos{7, 1, 7, ""}, Pos{9, 1, 9, ""}},
+		{Pos{11, 2, 2, ""}, Pos{15, 2, 5, ""}},
+		{Pos{16, 2, 6, ""}, Pos{17, 2, 7, ""}},
+		{Pos{30, 5, 3, "f.c"}, Pos{31, 5, 4, "f.c"}},
+		{Pos{31, 5, 4, "f.c"}, Pos{31, 5, 4, "f.c"}},
+	}
+
+	for i, test := range tt {
+		tok := l.Lex()
+		if tok.Start != test.start || tok.End != test.end {
+			t.Errorf("expected %v-%v at tt[%d], got %v-%v",
+				test.start, test.end, i, tok.Start, tok.End)
+		}
+		if tok.Line != tok.Start.Line || tok.Col != tok.Start.Col || tok.File != tok.Start.File {
+			t.Errorf("Line, Col and File differ from Start at tt[%d]", i)
+		}
+	}
+}
+func TestLookup(t *testing.T) {
+	if Lookup("while") != WHILE || Lookup("whilst") != IDENT {
+		t.Errorf("keyword lookup failed")
+	}
+	for _, s := range []string{"<<=", "...", "->", "{", ","} {
+		if ttype := Punctuator(s); Tmap[ttype] != s {
+			t.Errorf("expected %s, got %s", s, Tmap[ttype])
+		}
+	}
+	if Punctuator("<%") != LBRACE || Punctuator(":>") != RBRACKET {
+		t.Errorf("digraphs not recognized")
+	}
+	if Punctuator("#") != ERR || Punctuator("while") != ERR {
+		t.Errorf("non punctuators not rejected")
+	}
+}
@@ -1,5 +1,7 @@
 package lex
 
+import "math/big"
+
 const (
 	EOF = iota
 	ERR
@@ -96,4 +98,30 @@ type Token struct {
 	Col     uint
 	Line    uint
 	Literal string
+	// the file the token comes from, as told by linemarkers
+	File string
+	// where the token begins, and where the character following it is
+	Start Pos
+	End   Pos
+	// the value and the suffix as written of an integer or floating
+	// constant, whose literal is its whole spelling
+	Value  uint64
+	Float  *big.Rat
+	Suffix string
+	// the encoding prefix of a character constant, whose value is that
+	// of its type converted to uint64, or of a string literal
+	Prefix string
+	// the elements of a string literal, without the terminating null; its
+	// literal is their text
+	Units []uint32
+}
+
+// a place in the source: the byte offset from the start of the input, and
+// the line and column as told by linemarkers. Lines and columns count from
+// 1, columns in characters with a tab being one.
+type Pos struct {
+	Offset int
+	Line   uint
+	Col    uint
+	File   string
 }
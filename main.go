@@ -1,4 +1,192 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gorilla/cpp"
+)
+
+// a flag that may be given several times
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+func (l *list) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// -D and -U, kept in the order they were given
+type macros []cpp.MacroDef
+
+func (m *macros) String() string {
+	return ""
+}
+func (m *macros) define(s string) error {
+	*m = append(*m, cpp.MacroDef{Text: s})
+	return nil
+}
+func (m *macros) undef(s string) error {
+	*m = append(*m, cpp.MacroDef{Undef: true, Text: s})
+	return nil
+}
+
 func main() {
+	var quote, system list
+	var defs macros
+	flag.Var(&quote, "iquote", "add a directory searched by #include \"...\"")
+	flag.Var(&system, "I", "add a directory searched by both forms of #include")
+	flag.Func("D", "define a macro, as NAME or NAME=value", defs.define)
+	flag.Func("U", "undefine a macro", defs.undef)
+	out := flag.String("o", "", "write the output to `file` rather than stdout")
+	m := flag.Bool("M", false, "write the dependency rule instead of the preprocessed output")
+	mm := flag.Bool("MM", false, "like -M, leaving out system headers")
+	md := flag.Bool("MD", false, "write the dependency rule as well as the output")
+	mmd := flag.Bool("MMD", false, "like -MD, leaving out system headers")
+	mp := flag.Bool("MP", false, "add a phony target for every header")
+	mf := flag.String("MF", "", "write the dependency rule to `file`")
+	mt := flag.String("MT", "", "use `target` for the dependency rule")
+	markers := flag.Bool("linemarkers", false, "write linemarkers into the output")
+	partial := flag.Bool("unifdef", false, "only resolve the conditionals that -D and -U decide, leaving the rest of the source as it is")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: gorilla [flags] file.c\n\n"+
+				"Preprocesses file.c. Relative paths are taken from the working directory.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	name := path.Clean(filepath.ToSlash(flag.Arg(0)))
+
+	src, err := os.ReadFile(name)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *partial {
+		text, errs := cpp.Unifdef(string(src), defs)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) != 0 {
+			os.Exit(1)
+		}
+		err = write(*out, func(w io.Writer) error {
+			_, err := io.WriteString(w, text)
+			return err
+		})
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	p := cpp.NewParserOptions(cpp.New(string(src)), cpp.Options{
+		Filename:    name,
+		FS:          hostFS{os.DirFS("/")},
+		QuoteDirs:   quote,
+		SystemDirs:  system,
+		Macros:      defs,
+		Linemarkers: *markers,
+	})
+	expanded, errs := p.Expand()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) != 0 {
+		os.Exit(1)
+	}
+
+	deps := cpp.DepOptions{Target: *mt, NoSystem: *mm || *mmd, Phony: *mp}
+	switch {
+	case *m || *mm:
+		// only the rule is written, to -MF or else the output
+		if *mf == "" {
+			*mf = *out
+		}
+		err = write(*mf, func(w io.Writer) error { return p.WriteDeps(w, deps) })
+	case *md || *mmd:
+		if *mf == "" {
+			// next to the output, or named after the input
+			base := *out
+			if base == "" {
+				base = path.Base(name)
+			}
+			*mf = strings.TrimSuffix(base, path.Ext(base)) + ".d"
+		}
+		err = write(*out, func(w io.Writer) error {
+			_, err := io.WriteString(w, expanded)
+			return err
+		})
+		if err == nil {
+			err = write(*mf, func(w io.Writer) error { return p.WriteDeps(w, deps) })
+		}
+	default:
+		err = write(*out, func(w io.Writer) error {
+			_, err := io.WriteString(w, expanded)
+			return err
+		})
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// the files of the host, named by absolute paths or by paths relative to
+// the working directory, which may lead out of it; they are translated to
+// names in root, the file system rooted at /
+type hostFS struct {
+	root fs.FS
+}
+
+func (h hostFS) Open(name string) (fs.File, error) {
+	abs, err := filepath.Abs(filepath.FromSlash(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	rel := strings.TrimPrefix(filepath.ToSlash(abs), "/")
+	if rel == "" {
+		rel = "."
+	}
+
+	f, err := h.root.Open(rel)
+	if pe, ok := err.(*fs.PathError); ok {
+		pe.Path = name
+	}
+	return f, err
+}
+
+// runs f on the named file, or on stdout when name is empty
+func write(name string, f func(w io.Writer) error) error {
+	if name == "" {
+		return f(os.Stdout)
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := f(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "gorilla:", err)
+	os.Exit(1)
 }
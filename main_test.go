@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorilla/cpp"
+)
+
+func TestHostFS(t *testing.T) {
+	// a header outside of the working directory
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "h.h"), []byte("int h;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inc := range []string{filepath.ToSlash(dir), filepath.ToSlash(rel)} {
+		p := cpp.NewParserOptions(cpp.New("#include <h.h>\n"), cpp.Options{
+			Filename:   "m.c",
+			FS:         hostFS{os.DirFS("/")},
+			SystemDirs: []string{inc},
+		})
+		out, errs := p.Expand()
+		if len(errs) != 0 {
+			t.Errorf("-I %s: %v", inc, errs)
+		} else if out != "\nint h;\n" {
+			t.Errorf("-I %s: unexpected output %q", inc, out)
+		}
+	}
+
+	if _, err := (hostFS{os.DirFS("/")}).Open("nope.h"); err == nil {
+		t.Error("opened a file that does not exist")
+	} else if pe, ok := err.(*os.PathError); !ok || pe.Path != "nope.h" {
+		t.Errorf("expected the error to name nope.h, got %v", err)
+	}
+}
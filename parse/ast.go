@@ -3,6 +3,7 @@ package parse
 import (
 	"bytes"
 	"gorilla/lex"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -276,12 +277,70 @@ func (e *IndexExpr) String() string {
 }
 
 type Int struct {
-	Value int64
+	Value  uint64
+	Suffix string
 }
 
 func (e *Int) exprNode() {}
 func (e *Int) String() string {
-	return strconv.Itoa(int(e.Value))
+	return strconv.FormatUint(e.Value, 10) + e.Suffix
+}
+
+// the value is exactly the one written, which a floating type may only
+// approximate
+type Float struct {
+	Value  *big.Rat
+	Suffix string
+}
+
+func (e *Float) exprNode() {}
+
+// the value as the nearest double, spelled so that it reads as floating
+func (e *Float) String() string {
+	s := new(big.Float).SetPrec(53).SetRat(e.Value).Text('g', -1)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s + e.Suffix
+}
+
+// a character constant, its value being that of its type; the literal is
+// kept for the escape sequences to read as written
+type Char struct {
+	Value   int64
+	Prefix  string
+	Literal string
+}
+
+func (e *Char) exprNode() {}
+func (e *Char) String() string {
+	return e.Literal
+}
+
+// a string literal, adjacent ones already made one; the elements are those
+// of an array of Elem, the terminating null left out
+type String struct {
+	Value  string
+	Units  []uint32
+	Prefix string
+}
+
+func (e *String) exprNode() {}
+func (e *String) String() string {
+	return e.Prefix + strconv.Quote(e.Value)
+}
+
+// the element type by prefix, u8 making char as before C23
+func (e *String) Elem() string {
+	switch e.Prefix {
+	case "L":
+		return "wchar_t"
+	case "u":
+		return "char16_t"
+	case "U":
+		return "char32_t"
+	}
+	return "char"
 }
 
 type Ident struct {
@@ -2,7 +2,6 @@ package parse
 
 import (
 	"gorilla/lex"
-	"strconv"
 )
 
 func (p *Parser) parseExpr(currPrec uint) Expr {
@@ -45,8 +44,25 @@ func (p *Parser) parsePrefix() Expr {
 	case lex.IDENT:
 		return &Ident{Name: p.curr.Literal}
 	case lex.INT_CONST:
-		n, _ := strconv.Atoi(p.curr.Literal)
-		return &Int{Value: int64(n)}
+		return &Int{Value: p.curr.Value, Suffix: p.curr.Suffix}
+	case lex.CHAR_CONST:
+		return &Char{
+			Value:   int64(p.curr.Value),
+			Prefix:  p.curr.Prefix,
+			Literal: p.curr.Literal,
+		}
+	case lex.STRING:
+		return &String{
+			Value:  p.curr.Literal,
+			Units:  p.curr.Units,
+			Prefix: p.curr.Prefix,
+		}
+	case lex.FLOAT_CONST:
+		return &Float{Value: p.curr.Float, Suffix: p.curr.Suffix}
+	case lex.ERR:
+		// malformed constants and the like, told by the lexer
+		p.error("%s", p.curr.Literal)
+		return nil
 	case lex.ADD, lex.SUB, lex.NOT, lex.INC, lex.DEC,
 		lex.BAND, lex.BCOMP:
 		return p.parsePrefixOperator()
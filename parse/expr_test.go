@@ -1,6 +1,10 @@
 package parse
 
-import "testing"
+import (
+	"gorilla/lex"
+	"strings"
+	"testing"
+)
 
 func TestInfix(t *testing.T) {
 	tt := []Pair{
@@ -27,6 +31,69 @@ func TestInfix(t *testing.T) {
 	check(t, tt)
 }
 
+func TestIntegerConstants(t *testing.T) {
+	tt := []Pair{
+		{"0x1F + 010;", "(31 + 8)"},
+		{"10UL * 3ll;", "(10UL * 3ll)"},
+		{"18446744073709551615u;", "18446744073709551615u"},
+	}
+	check(t, tt)
+}
+
+func TestFloatingConstants(t *testing.T) {
+	tt := []Pair{
+		{"3.14;", "3.14"},
+		{"1.5e3 + .5;", "(1500.0 + 0.5)"},
+		{"1e-2f * 2.L;", "(0.01f * 2.0L)"},
+		{"0x1.8p3 - 0x.8P-1;", "(12.0 - 0.25)"},
+		{"1E+2;", "100.0"},
+	}
+	check(t, tt)
+}
+
+func TestCharConstants(t *testing.T) {
+	tt := []Pair{
+		{"c == '\\n';", "(c == '\\n')"},
+		{"'a' + L'\\x41' - u8'b';", "(('a' + L'\\x41') - u8'b')"},
+	}
+	check(t, tt)
+
+	l := lex.New(`'\xff' + U'\U0001F600';`)
+	tree, err := New(l).Parse()
+	if len(err) != 0 {
+		t.Fatal(err)
+	}
+	e := tree[0].(*ExprStmt).Expr.(*InfixExpr)
+	if e.Left.(*Char).Value != -1 || e.Right.(*Char).Value != 0x1f600 {
+		t.Errorf("wrong values for %s", e)
+	}
+}
+
+func TestStringLiterals(t *testing.T) {
+	tt := []Pair{
+		{`"a\"b";`, `"a\"b"`},
+		{`s = "a" "b\n";`, `(s = "ab\n")`},
+		{`f("x", u8"é" "\u00e9");`, `(f "x" u8"éé")`},
+	}
+	check(t, tt)
+
+	elems := map[string]string{
+		`"a";`: "char", `u8"a";`: "char", `L"a";`: "wchar_t",
+		`"a" u"b";`: "char16_t", `U"a";`: "char32_t",
+	}
+	for input, elem := range elems {
+		tree, err := New(lex.New(input)).Parse()
+		if len(err) != 0 {
+			t.Fatal(err)
+		}
+		s := tree[0].(*ExprStmt).Expr.(*String)
+		if s.Elem() != elem || len(s.Units) != strings.Count(input, `"`)/2 {
+			t.Errorf("expected %d elements of %s for %s, got %v of %s",
+				strings.Count(input, `"`)/2, elem, input, s.Units, s.Elem())
+		}
+	}
+}
+
 func TestAssign(t *testing.T) {
 	tt := []Pair{
 		{"1 = 2;", "(1 = 2)"},
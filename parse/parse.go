@@ -65,14 +65,14 @@ var prec = map[uint]uint{
 }
 
 type Parser struct {
-	l     *lex.Lexer
+	l     lex.Source
 	curr  lex.Token
 	next  lex.Token
 	types map[string]bool
 	err   []error
 }
 
-func New(l *lex.Lexer) *Parser {
+func New(l lex.Source) *Parser {
 	p := &Parser{l: l}
 
 	p.adv()
@@ -146,6 +146,13 @@ func (p *Parser) expect(ttype uint) bool {
 func toks(ttype uint) string {
 	return lex.Tmap[ttype]
 }
+
+// errors point at the current token
 func (p *Parser) error(format string, rest ...any) {
-	p.err = append(p.err, fmt.Errorf(format, rest...))
+	msg := fmt.Sprintf(format, rest...)
+	if pos := p.curr.Start; pos.File != "" {
+		p.err = append(p.err, fmt.Errorf("%s:%d:%d: %s", pos.File, pos.Line, pos.Col, msg))
+	} else {
+		p.err = append(p.err, fmt.Errorf("%d:%d: %s", pos.Line, pos.Col, msg))
+	}
 }
@@ -33,3 +33,21 @@ func check(t *testing.T, tt []Pair) {
 		}
 	}
 }
+
+func TestErrorPositions(t *testing.T) {
+	tt := []Pair{
+		{"x = 1;\n  y = (é;", "2:9: expected ), got ;"},
+		{"# 7 \"a.c\"\nwhile (x) \t1 2;", "a.c:7:14: expected ;, got int_const"},
+		{"x = 1 + 08;", "1:9: invalid digit \"8\" in octal constant"},
+		{"x = 0x;", "1:5: invalid integer constant \"0x\""},
+	}
+
+	for _, test := range tt {
+		_, err := New(lex.New(test.input)).Parse()
+		if len(err) == 0 {
+			t.Errorf("no error reported for %q", test.input)
+		} else if err[0].Error() != test.output {
+			t.Errorf("expected %q, got %q", test.output, err[0].Error())
+		}
+	}
+}